@@ -0,0 +1,249 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kobolog/gorb/ipvs-shim"
+	"github.com/kobolog/gorb/pulse"
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// adopt imports virtual services and backends which are already in IPVS, e.g. left
+// by a previous instance, so that they keep forwarding traffic across restarts.
+// Adopted objects get synthetic IDs and are claimed when created again with the
+// same endpoints, e.g. by the store synchronization.
+func (ctx *Context) adopt() error {
+	svcs, err := ctx.ipvs.ListServices()
+	if err != nil {
+		return err
+	}
+
+	services := make(map[string]*service)
+	backends := make(map[string]*backend)
+
+	for _, svc := range svcs {
+		vsID, opts := adoptedServiceOptions(svc)
+		vs := &service{options: opts, adopted: true}
+
+		dests, err := ctx.ipvs.ListDestinations(opts.host.String(), opts.Port, opts.Protocol, opts.FwMark)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("adopting virtual service [%s] with %d backend(s)", vsID, len(dests))
+
+		services[vsID] = vs
+
+		for _, dest := range dests {
+			rsID := fmt.Sprintf("%s-%s-%d", vsID, dest.Host, dest.Port)
+
+			// Adopted backends are not health checked until they're claimed.
+			rsOpts := &BackendOptions{
+				Host:   dest.Host,
+				Port:   dest.Port,
+				Weight: dest.Weight,
+				Method: dest.Fwd,
+				Pulse:  &pulse.Options{Type: "none"},
+				VsID:   vsID,
+				host:   net.ParseIP(dest.Host),
+			}
+
+			p, err := pulse.New(dest.Host, dest.Port, rsOpts.Pulse)
+			if err != nil {
+				return err
+			}
+
+			backends[rsID] = &backend{options: rsOpts, service: vs, monitor: p, adopted: true,
+				weight: dest.Weight}
+		}
+	}
+
+	for vsID, vs := range services {
+		ctx.services[vsID] = vs
+	}
+
+	for rsID, rs := range backends {
+		ctx.backends[rsID] = rs
+		go rs.monitor.Loop(pulse.ID{VsID: rs.options.VsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
+	}
+
+	return nil
+}
+
+// adoptedServiceOptions converts a service found in IPVS into service options.
+func adoptedServiceOptions(svc *ipvs_shim.Service) (string, *ServiceOptions) {
+	opts := &ServiceOptions{
+		Host:     svc.VIP,
+		Port:     svc.Port,
+		Protocol: svc.Protocol,
+		Method:   svc.Sched,
+		FwMark:   svc.FwMark,
+		host:     net.ParseIP(svc.VIP),
+	}
+
+	if len(svc.Flags) > 0 {
+		opts.Flags = strings.Join(svc.Flags, "|")
+	}
+
+	if svc.Timeout > 0 {
+		opts.Persistent = true
+		opts.PersistenceTimeout = strconv.Itoa(int(svc.Timeout)) + "s"
+		opts.PersistenceNetmask = svc.Netmask
+		opts.timeout = svc.Timeout
+	}
+
+	if svc.FwMark == 0 {
+		return fmt.Sprintf("%s-%d-%s", svc.VIP, svc.Port, svc.Protocol), opts
+	}
+
+	// Firewall mark services have no VIP or protocol, only an address family.
+	family := "ipv4"
+	opts.Protocol = "tcp"
+	opts.host = net.IPv4zero
+	if svc.Family == util.IPv6 {
+		family = "ipv6"
+		opts.host = net.IPv6unspecified
+	}
+	opts.Host = opts.host.String()
+
+	return fmt.Sprintf("fwmark-%d-%s", svc.FwMark, family), opts
+}
+
+// sameEndpoint checks whether two services are the same IPVS service.
+func sameEndpoint(a, b *ServiceOptions) bool {
+	if a.FwMark != b.FwMark {
+		return false
+	} else if a.FwMark != 0 {
+		return util.AddrFamily(a.host) == util.AddrFamily(b.host)
+	}
+	return a.host.Equal(b.host) && a.Port == b.Port && a.Protocol == b.Protocol
+}
+
+// adoptedService finds an adopted service with the same endpoint.
+func (ctx *Context) adoptedService(opts *ServiceOptions) (string, bool) {
+	for vsID, vs := range ctx.services {
+		if vs.adopted && sameEndpoint(vs.options, opts) {
+			return vsID, true
+		}
+	}
+	return "", false
+}
+
+// adoptedBackend finds an adopted backend of a service with the same endpoint.
+func (ctx *Context) adoptedBackend(vs *service, opts *BackendOptions) (string, bool) {
+	for rsID, rs := range ctx.backends {
+		if rs.adopted && rs.service == vs && rs.options.host.Equal(opts.host) && rs.options.Port == opts.Port {
+			return rsID, true
+		}
+	}
+	return "", false
+}
+
+// claimService turns an adopted service into a regular one and updates it.
+func (ctx *Context) claimService(adoptedID, vsID string, opts *ServiceOptions) error {
+	vs := ctx.services[adoptedID]
+
+	log.Infof("claiming adopted virtual service [%s] as [%s]", adoptedID, vsID)
+
+	delete(ctx.services, adoptedID)
+	ctx.services[vsID] = vs
+
+	for _, rs := range ctx.backends {
+		if rs.service == vs {
+			rs.options.VsID = vsID
+		}
+	}
+
+	// Firewall mark services were adopted without a VIP, port and protocol.
+	vs.options.Host, vs.options.host = opts.Host, opts.host
+	vs.options.Port, vs.options.Protocol = opts.Port, opts.Protocol
+	vs.options.FwMarkPorts = opts.FwMarkPorts
+
+	if ctx.vipInterface != nil {
+		// Most likely the VIP was added by a previous instance.
+		err := netlink.AddrAdd(ctx.vipInterface, vipAddr(opts.host))
+		if err == nil || err == syscall.EEXIST {
+			vs.options.delIfAddr = true
+		} else {
+			log.Infof("failed to add VIP %s for service [%s]: %s", opts.host, vsID, err)
+		}
+	}
+
+	if len(opts.FwMarkPorts) > 0 {
+		if err := ensureFwMarkRule(vsID, opts); err != nil {
+			log.Errorf("failed to add firewall mark rule for service [%s]: %s", vsID, err)
+		} else {
+			vs.options.delFwMarkRule = true
+		}
+	}
+
+	return ctx.updateService(vsID, opts)
+}
+
+// claimBackend turns an adopted backend into a regular one and updates it.
+func (ctx *Context) claimBackend(adoptedID, vsID, rsID string, opts *BackendOptions, p *pulse.Pulse) error {
+	rs := ctx.backends[adoptedID]
+
+	log.Infof("claiming adopted backend [%s] as [%s/%s]", adoptedID, vsID, rsID)
+
+	if ctx.store != nil {
+		if err := ctx.store.CreateBackend(vsID, rsID, opts); err != nil {
+			log.Errorf("error while create backend : %s", err)
+			return err
+		}
+	}
+
+	if err := ctx.ipvs.UpdateDestPort(
+		rs.service.options.host.String(),
+		rs.service.options.Port,
+		opts.host.String(),
+		opts.Port,
+		rs.service.options.Protocol,
+		rs.service.options.FwMark,
+		opts.Weight,
+		opts.Method,
+	); err != nil {
+		log.Errorf("error while claiming backend: %s", err)
+		return ErrIpvsSyscallFailed
+	}
+
+	// Replace the placeholder pulse with the configured one, the backend stays.
+	rs.monitor.StopSilently()
+
+	delete(ctx.backends, adoptedID)
+
+	opts.VsID = vsID
+	rs.options, rs.monitor, rs.adopted, rs.weight = opts, p, false, opts.Weight
+	ctx.backends[rsID] = rs
+
+	go rs.monitor.Loop(pulse.ID{VsID: vsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
+
+	return nil
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kobolog/gorb/ipvs-shim"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Possible connection filter errors.
+var (
+	ErrInvalidClientFilter = errors.New("client filter must be an address or a network")
+	ErrInvalidPagination   = errors.New("offset and limit must not be negative")
+)
+
+// DefaultConnectionLimit is the page size used if no limit is specified.
+const DefaultConnectionLimit = 100
+
+// ConnectionFilter selects a page of IPVS connection entries. Client is either an
+// address or a network in CIDR notation, State is matched case-insensitively.
+type ConnectionFilter struct {
+	Client string
+	State  string
+	Offset int
+	Limit  int
+}
+
+// Connection describes an IPVS connection entry.
+type Connection struct {
+	Protocol string `json:"protocol"`
+	Client   string `json:"client"`
+	VIP      string `json:"vip"`
+	Backend  string `json:"backend"`
+	RsID     string `json:"rsid,omitempty"`
+	State    string `json:"state"`
+	Expires  string `json:"expires"`
+}
+
+// ConnectionList is a page of IPVS connection entries, Total is the number of
+// entries matching the filter.
+type ConnectionList struct {
+	Total       int          `json:"total"`
+	Offset      int          `json:"offset"`
+	Connections []Connection `json:"connections"`
+}
+
+func (f *ConnectionFilter) clientMatcher() (func(net.IP) bool, error) {
+	if len(f.Client) == 0 {
+		return func(net.IP) bool { return true }, nil
+	} else if ip := net.ParseIP(f.Client); ip != nil {
+		return ip.Equal, nil
+	} else if _, network, err := net.ParseCIDR(f.Client); err == nil {
+		return network.Contains, nil
+	}
+	return nil, ErrInvalidClientFilter
+}
+
+// connectionBackends maps the addresses of the backends of a virtual service to
+// their IDs, backends without a port are mapped with port 0. The caller must hold
+// the mutex.
+func (ctx *Context) connectionBackends(vs *service) map[string]string {
+	backends := make(map[string]string)
+	for rsID, rs := range ctx.backends {
+		if rs.service == vs {
+			backends[net.JoinHostPort(rs.options.host.String(), strconv.Itoa(int(rs.options.Port)))] = rsID
+		}
+	}
+	return backends
+}
+
+// connectionBackend returns the ID of the backend a connection is forwarded to.
+func connectionBackend(conn *ipvs_shim.Connection, backends map[string]string) string {
+	host := net.ParseIP(conn.Dest).String()
+	if rsID, exists := backends[net.JoinHostPort(host, strconv.Itoa(int(conn.DPort)))]; exists {
+		return rsID
+	}
+	return backends[net.JoinHostPort(host, "0")]
+}
+
+// matchesService checks whether a connection was scheduled by a virtual service.
+func matchesService(conn *ipvs_shim.Connection, opts *ServiceOptions, backends map[string]string) bool {
+	if opts.FwMark == 0 {
+		return conn.Protocol == opts.Protocol && conn.VPort == opts.Port && opts.host.Equal(net.ParseIP(conn.VIP))
+	}
+
+	// Firewall mark connections are only distinguishable by their backends.
+	return connectionBackend(conn, backends) != ""
+}
+
+// ListConnections returns IPVS connection entries of a virtual service, or of one of
+// its backends if rsID is set.
+func (ctx *Context) ListConnections(vsID, rsID string, filter ConnectionFilter) (*ConnectionList, error) {
+	matchClient, err := filter.clientMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Offset < 0 || filter.Limit < 0 {
+		return nil, ErrInvalidPagination
+	} else if filter.Limit == 0 {
+		filter.Limit = DefaultConnectionLimit
+	}
+
+	// The connection table can be huge, so it's read without holding the mutex.
+	conns, err := ctx.ipvs.ListConnections()
+	if err != nil {
+		log.Errorf("error while listing connections: %s", err)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	ctx.mutex.RLock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		ctx.mutex.RUnlock()
+		return nil, ErrObjectNotFound
+	}
+
+	if len(rsID) > 0 {
+		if rs, exists := ctx.backends[rsID]; !exists || rs.service != vs {
+			ctx.mutex.RUnlock()
+			return nil, ErrObjectNotFound
+		}
+	}
+
+	opts, backends := *vs.options, ctx.connectionBackends(vs)
+
+	ctx.mutex.RUnlock()
+
+	var matches []Connection
+
+	for _, conn := range conns {
+		if !matchesService(conn, &opts, backends) || !matchClient(net.ParseIP(conn.Client)) {
+			continue
+		} else if len(filter.State) > 0 && !strings.EqualFold(filter.State, conn.State) {
+			continue
+		}
+
+		connRsID := connectionBackend(conn, backends)
+		if len(rsID) > 0 && connRsID != rsID {
+			continue
+		}
+
+		matches = append(matches, Connection{
+			Protocol: conn.Protocol,
+			Client:   net.JoinHostPort(conn.Client, strconv.Itoa(int(conn.ClientPort))),
+			VIP:      net.JoinHostPort(conn.VIP, strconv.Itoa(int(conn.VPort))),
+			Backend:  net.JoinHostPort(conn.Dest, strconv.Itoa(int(conn.DPort))),
+			RsID:     connRsID,
+			State:    conn.State,
+			Expires:  conn.Expires.String(),
+		})
+	}
+
+	// The kernel lists connections in hash order, sort them for stable pages.
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Client != matches[j].Client {
+			return matches[i].Client < matches[j].Client
+		}
+		return matches[i].Backend < matches[j].Backend
+	})
+
+	result := &ConnectionList{Total: len(matches), Offset: filter.Offset, Connections: []Connection{}}
+
+	if filter.Offset < len(matches) {
+		// Huge limits would overflow the end of the page.
+		if filter.Limit > len(matches)-filter.Offset {
+			filter.Limit = len(matches) - filter.Offset
+		}
+		result.Connections = matches[filter.Offset : filter.Offset+filter.Limit]
+	}
+
+	return result, nil
+}
@@ -24,7 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/kobolog/gorb/disco"
 	"github.com/kobolog/gorb/pulse"
@@ -37,16 +39,27 @@ import (
 	"github.com/kobolog/gorb/ipvs-shim"
 )
 
+// IFA_F_NODAD from linux/if_addr.h, not exported by syscall on all platforms.
+const ifaFlagNoDAD = 0x02
+
 // Possible runtime errors.
 var (
 	ErrIpvsSyscallFailed = errors.New("error while calling into IPVS")
 	ErrObjectExists      = errors.New("specified object already exists")
 	ErrObjectNotFound    = errors.New("unable to locate specified object")
 	ErrIncompatibleAFs   = errors.New("incompatible address families")
+	ErrFallbackIsBackend = errors.New("fallback backend is also a regular backend of the service")
 )
 
 type service struct {
 	options *ServiceOptions
+	adopted bool
+
+	// Set if fewer backends are healthy than required, see ServiceOptions.MinHealthy.
+	panic bool
+
+	// Set while the fallback backend is in IPVS, see ServiceOptions.Fallback.
+	fallback bool
 }
 
 type backend struct {
@@ -54,6 +67,37 @@ type backend struct {
 	service *service
 	monitor *pulse.Pulse
 	metrics pulse.Metrics
+	adopted bool
+	drain   *DrainInfo
+
+	// Passive health checking state: the current ejection, if any, and the last
+	// IPVS statistics sample.
+	ejection *EjectionInfo
+	sample   *ipvs_shim.Destination
+
+	// Start of the current up streak, used to ramp up weights of recovering backends.
+	upSince time.Time
+
+	// Configured weight, and the weight set by latency-aware scaling if any. The
+	// latter is only written to IPVS, options keep the unscaled weight.
+	weight uint32
+	scaled uint32
+
+	// Set while the backend has a stash entry, i.e. it's down or still recovering,
+	// and if its weight has been patched meanwhile, see patchBackend.
+	stashed bool
+	patched bool
+}
+
+// ipvsWeight is the weight the backend is supposed to have in IPVS. Stashed and
+// drained backends already have their options updated with a zero weight.
+func (rs *backend) ipvsWeight() uint32 {
+	if rs.drain != nil {
+		return 0
+	} else if rs.scaled != 0 {
+		return rs.scaled
+	}
+	return rs.options.Weight
 }
 
 // Context abstacts away the underlying IPVS bindings implementation.
@@ -68,6 +112,9 @@ type Context struct {
 	stopCh       chan struct{}
 	vipInterface netlink.Link
 	store        *Store
+
+	// Result of the last drift check, if any.
+	drift *DriftReport
 }
 
 // NewContext creates a new Context and initializes IPVS.
@@ -119,6 +166,12 @@ func NewContext(options ContextOptions) (*Context, error) {
 		log.Errorf("unable to clean up IPVS pools - ensure ip_vs is loaded")
 		ctx.Close()
 		return nil, ErrIpvsSyscallFailed
+	} else if !options.Flush && options.Adopt {
+		if err := ctx.adopt(); err != nil {
+			log.Errorf("unable to adopt existing IPVS pools: %s", err)
+			ctx.Close()
+			return nil, ErrIpvsSyscallFailed
+		}
 	}
 
 	if options.VipInterface != "" {
@@ -135,6 +188,16 @@ func NewContext(options ContextOptions) (*Context, error) {
 	// Fire off a pulse notifications sink goroutine.
 	go ctx.run()
 
+	if options.DriftInterval > 0 {
+		log.Infof("checking IPVS for drift every %s", options.DriftInterval)
+		go ctx.reconcile(options.DriftInterval, options.DriftRepair)
+	}
+
+	if options.Passive.Interval > 0 {
+		log.Infof("checking backend IPVS statistics every %s", options.Passive.Interval)
+		go ctx.watchPassive(options.Passive)
+	}
+
 	return ctx, nil
 }
 
@@ -150,6 +213,19 @@ func (ctx *Context) Close() {
 	}
 }
 
+// vipAddr returns a host route sized address (/32 or /128) for a VIP.
+func vipAddr(host net.IP) *netlink.Addr {
+	if util.AddrFamily(host) == util.IPv4 {
+		return &netlink.Addr{IPNet: &net.IPNet{IP: host.To4(), Mask: net.CIDRMask(32, 32)}}
+	}
+
+	// Skip duplicate address detection, otherwise the VIP stays tentative
+	// and unusable for a couple of seconds after being added.
+	return &netlink.Addr{
+		IPNet: &net.IPNet{IP: host.To16(), Mask: net.CIDRMask(128, 128)},
+		Flags: ifaFlagNoDAD}
+}
+
 // CreateService registers a new virtual service with IPVS.
 func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 	if err := opts.Fill(ctx.endpoint); err != nil {
@@ -160,11 +236,13 @@ func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 		return ErrObjectExists
 	}
 
+	if adoptedID, exists := ctx.adoptedService(opts); exists {
+		return ctx.claimService(adoptedID, vsID, opts)
+	}
+
 	if ctx.vipInterface != nil {
 		ifName := ctx.vipInterface.Attrs().Name
-		vip := &netlink.Addr{IPNet: &net.IPNet{
-			net.ParseIP(opts.host.String()), net.IPv4Mask(255, 255, 255, 255)}}
-		if err := netlink.AddrAdd(ctx.vipInterface, vip); err != nil {
+		if err := netlink.AddrAdd(ctx.vipInterface, vipAddr(opts.host)); err != nil {
 			log.Infof(
 				"failed to add VIP %s to interface '%s' for service [%s]: %s",
 				opts.host, ifName, vsID, err)
@@ -189,13 +267,27 @@ func (ctx *Context) createService(vsID string, opts *ServiceOptions) error {
 	if len(opts.Flags) > 0 {
 		flags = strings.Split(opts.Flags, "|")
 	}
-	if err := ctx.ipvs.AddService(opts.host.String(), opts.Port, opts.Protocol, opts.Method, flags); err != nil {
+	if err := ctx.ipvs.AddService(opts.host.String(), opts.Port, opts.Protocol, opts.FwMark, opts.Method, flags,
+		opts.timeout, opts.PersistenceNetmask); err != nil {
 		log.Errorf("error while creating virtual service: %s", err)
 		return ErrIpvsSyscallFailed
 	}
 
+	if len(opts.FwMarkPorts) > 0 {
+		if err := addFwMarkRule(vsID, opts); err != nil {
+			log.Errorf(
+				"failed to add firewall mark rule for service [%s]: %s", vsID, err)
+		} else {
+			opts.delFwMarkRule = true
+			log.Infof("firewall mark rule has been added for service [%s]", vsID)
+		}
+	}
+
 	ctx.services[vsID] = &service{options: opts}
 
+	// There are no backends yet, so the fallback backend is needed right away.
+	ctx.refreshFallback(vsID, ctx.services[vsID])
+
 	if err := ctx.disco.Expose(vsID, opts.host.String(), opts.Port); err != nil {
 		log.Errorf("error while exposing service to Disco: %s", err)
 	}
@@ -225,10 +317,22 @@ func (ctx *Context) updateService(vsID string, opts *ServiceOptions) error {
 	// Check if not possible to update.
 	if old.options.host.String() != opts.host.String() ||
 		old.options.Port != opts.Port ||
-		old.options.Protocol != opts.Protocol {
-		return fmt.Errorf("unable to update virtual service [%s] due to host/port/protocol changing", vsID)
+		old.options.Protocol != opts.Protocol ||
+		old.options.FwMark != opts.FwMark ||
+		old.options.FwMarkPorts != opts.FwMarkPorts {
+		return fmt.Errorf("unable to update virtual service [%s] due to host/port/protocol/fwmark changing", vsID)
+	}
+
+	for _, rs := range ctx.backends {
+		if rs.service == old && isFallback(opts, rs.options) {
+			return ErrFallbackIsBackend
+		}
 	}
 
+	// The VIP and mark rule are left untouched, so they still have to be removed eventually.
+	opts.delIfAddr = old.options.delIfAddr
+	opts.delFwMarkRule = old.options.delFwMarkRule
+
 	log.Infof("updating virtual service [%s] on %s:%d", vsID, opts.host,
 		opts.Port)
 
@@ -244,12 +348,22 @@ func (ctx *Context) updateService(vsID string, opts *ServiceOptions) error {
 	if len(opts.Flags) > 0 {
 		flags = strings.Split(opts.Flags, "|")
 	}
-	if err := ctx.ipvs.UpdateService(opts.host.String(), opts.Port, opts.Protocol, opts.Method, flags); err != nil {
+	if err := ctx.ipvs.UpdateService(opts.host.String(), opts.Port, opts.Protocol, opts.FwMark, opts.Method, flags,
+		opts.timeout, opts.PersistenceNetmask); err != nil {
 		log.Errorf("error while updating virtual service: %s", err)
 		return ErrIpvsSyscallFailed
 	}
 
-	ctx.services[vsID] = &service{options: opts}
+	// A changed fallback backend is removed, and added back below if still needed.
+	if prev, next := old.options.Fallback, opts.Fallback; prev != nil && (next == nil ||
+		!prev.CompareStoreOptions(next) || prev.Weight != next.Weight) {
+		ctx.setFallback(vsID, old, false)
+	}
+
+	// Update in place, as backends are referencing the service.
+	old.options, old.adopted = opts, false
+
+	ctx.refreshFallback(vsID, old)
 
 	if err := ctx.disco.Expose(vsID, opts.host.String(), opts.Port); err != nil {
 		log.Errorf("error while exposing service to Disco: %s", err)
@@ -265,15 +379,36 @@ func (ctx *Context) UpdateService(vsID string, opts *ServiceOptions) error {
 	return ctx.updateService(vsID, opts)
 }
 
+// isFallback checks whether a backend has the address of the fallback backend of a
+// service, which would be removed along with the fallback backend otherwise.
+func isFallback(vs *ServiceOptions, opts *BackendOptions) bool {
+	return vs.Fallback != nil && vs.Fallback.host.Equal(opts.host) && vs.Fallback.Port == opts.Port
+}
+
+// newBackendPulse creates the health check for a backend of a virtual service.
+func newBackendPulse(vs *service, opts *BackendOptions) (*pulse.Pulse, error) {
+	// Only firewall mark services can forward to the original destination port.
+	port := opts.Port
+	if port == 0 {
+		if vs.options.FwMark == 0 {
+			return nil, ErrMissingEndpoint
+		}
+		port = vs.options.Port
+	}
+
+	if len(opts.Pulse.Type) == 0 && vs.options.Protocol == "sctp" {
+		// The default TCP pulse can't reach SCTP backends.
+		opts.Pulse.Type = "sctp"
+	}
+
+	return pulse.New(opts.host.String(), port, opts.Pulse)
+}
+
 // CreateBackend registers a new backend with a virtual service.
 func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error {
 	if err := opts.Fill(); err != nil {
 		return err
 	}
-	p, err := pulse.New(opts.host.String(), opts.Port, opts.Pulse)
-	if err != nil {
-		return err
-	}
 
 	if _, exists := ctx.backends[rsID]; exists {
 		return ErrObjectExists
@@ -287,6 +422,17 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 
 	if util.AddrFamily(opts.host) != util.AddrFamily(vs.options.host) {
 		return ErrIncompatibleAFs
+	} else if isFallback(vs.options, opts) {
+		return ErrFallbackIsBackend
+	}
+
+	p, err := newBackendPulse(vs, opts)
+	if err != nil {
+		return err
+	}
+
+	if adoptedID, exists := ctx.adoptedBackend(vs, opts); exists {
+		return ctx.claimBackend(adoptedID, vsID, rsID, opts, p)
 	}
 
 	log.Infof("creating backend [%s] on %s:%d for virtual service [%s]",
@@ -309,6 +455,7 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 		opts.host.String(),
 		opts.Port,
 		vs.options.Protocol,
+		vs.options.FwMark,
 		opts.Weight,
 		opts.Method,
 	); err != nil {
@@ -316,7 +463,10 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 		return ErrIpvsSyscallFailed
 	}
 
-	ctx.backends[rsID] = &backend{options: opts, service: vs, monitor: p}
+	ctx.backends[rsID] = &backend{options: opts, service: vs, monitor: p, weight: opts.Weight}
+
+	// New backends are considered healthy until their first check.
+	ctx.refreshFallback(vsID, vs)
 
 	// Fire off the configured pulse goroutine, attach it to the Context.
 	go ctx.backends[rsID].monitor.Loop(pulse.ID{VsID: vsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
@@ -337,6 +487,8 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight uint32) (uint32, err
 
 	if !exists {
 		return 0, ErrObjectNotFound
+	} else if rs.drain != nil {
+		return 0, ErrBackendDraining
 	}
 
 	log.Infof("updating backend [%s/%s] with weight: %d", vsID, rsID,
@@ -348,6 +500,7 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight uint32) (uint32, err
 		rs.options.host.String(),
 		rs.options.Port,
 		rs.service.options.Protocol,
+		rs.service.options.FwMark,
 		weight,
 		rs.options.Method,
 	); err != nil {
@@ -358,7 +511,7 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight uint32) (uint32, err
 	var result uint32
 
 	// Save the old backend weight and update the current backend weight.
-	result, rs.options.Weight = rs.options.Weight, weight
+	result, rs.options.Weight, rs.scaled = rs.options.Weight, weight, 0
 
 	// Currently the backend options are changing only the weight.
 	// The weight value is set to the value requested at the first setting,
@@ -379,6 +532,91 @@ func (ctx *Context) UpdateBackend(vsID, rsID string, weight uint32) (uint32, err
 	return ctx.updateBackend(vsID, rsID, weight)
 }
 
+// patchBackend applies all mutable backend options, replacing its pulse if needed.
+func (ctx *Context) patchBackend(vsID, rsID string, opts *BackendOptions) error {
+	rs, exists := ctx.backends[rsID]
+
+	if !exists {
+		return ErrObjectNotFound
+	} else if rs.drain != nil {
+		return ErrBackendDraining
+	}
+
+	// Unlike on creation, a zero weight is allowed to disable the backend.
+	weight := opts.Weight
+	if err := opts.Fill(); err != nil {
+		return err
+	}
+	opts.Weight = weight
+
+	if !opts.host.Equal(rs.options.host) || opts.Port != rs.options.Port {
+		return fmt.Errorf("unable to update backend [%s/%s] due to host/port changing", vsID, rsID)
+	}
+
+	opts.VsID = rs.options.VsID
+
+	// Unhealthy and recovering backends have their weight stashed until they've
+	// recovered, and the new weight is only restored then.
+	if rs.stashed {
+		weight = rs.options.Weight
+	}
+
+	monitor := rs.monitor
+	if !reflect.DeepEqual(opts.Pulse, rs.options.Pulse) {
+		var err error
+		if monitor, err = newBackendPulse(rs.service, opts); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("updating backend [%s/%s] with weight %d and method %s", vsID, rsID,
+		opts.Weight, opts.Method)
+
+	// update backend in external store
+	if ctx.store != nil {
+		if err := ctx.store.UpdateBackend(vsID, rsID, opts); err != nil {
+			log.Errorf("error while updating backend : %s", err)
+			return err
+		}
+	}
+
+	if err := ctx.ipvs.UpdateDestPort(
+		rs.service.options.host.String(),
+		rs.service.options.Port,
+		opts.host.String(),
+		opts.Port,
+		rs.service.options.Protocol,
+		rs.service.options.FwMark,
+		weight,
+		opts.Method,
+	); err != nil {
+		log.Errorf("error while updating backend [%s/%s]", vsID, rsID)
+		return ErrIpvsSyscallFailed
+	}
+
+	if monitor != rs.monitor {
+		log.Infof("replacing pulse of backend [%s/%s]", vsID, rsID)
+
+		// The backend isn't removed, so its stashed weight must be kept.
+		rs.monitor.StopSilently()
+		rs.monitor = monitor
+
+		go rs.monitor.Loop(pulse.ID{VsID: vsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
+	}
+
+	rs.options, rs.weight, rs.patched, rs.scaled = opts, opts.Weight, rs.stashed, 0
+	rs.options.Weight = weight
+
+	return nil
+}
+
+// PatchBackend applies all mutable backend options, replacing its pulse if needed.
+func (ctx *Context) PatchBackend(vsID, rsID string, opts *BackendOptions) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.patchBackend(vsID, rsID, opts)
+}
+
 // RemoveService deregisters a virtual service.
 func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 	vs, exists := ctx.services[vsID]
@@ -391,9 +629,7 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 
 	if ctx.vipInterface != nil && vs.options.delIfAddr == true {
 		ifName := ctx.vipInterface.Attrs().Name
-		vip := &netlink.Addr{IPNet: &net.IPNet{
-			net.ParseIP(vs.options.host.String()), net.IPv4Mask(255, 255, 255, 255)}}
-		if err := netlink.AddrDel(ctx.vipInterface, vip); err != nil {
+		if err := netlink.AddrDel(ctx.vipInterface, vipAddr(vs.options.host)); err != nil {
 			log.Infof(
 				"failed to delete VIP %s to interface '%s' for service [%s]: %s",
 				vs.options.host, ifName, vsID, err)
@@ -409,11 +645,19 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 		vs.options.host.String(),
 		vs.options.Port,
 		vs.options.Protocol,
+		vs.options.FwMark,
 	); err != nil {
 		log.Errorf("error while removing virtual service [%s]", vsID)
 		return nil, ErrIpvsSyscallFailed
 	}
 
+	if vs.options.delFwMarkRule {
+		if err := delFwMarkRule(vsID, vs.options); err != nil {
+			log.Errorf(
+				"failed to delete firewall mark rule for service [%s]: %s", vsID, err)
+		}
+	}
+
 	// delete service from external store
 	if ctx.store != nil {
 		if err := ctx.store.RemoveService(vsID); err != nil {
@@ -464,29 +708,34 @@ func (ctx *Context) removeBackend(vsID, rsID string) (*BackendOptions, error) {
 
 	log.Infof("removing backend [%s/%s]", vsID, rsID)
 
-	// delete backend from external store
-	if ctx.store != nil {
-		if err := ctx.store.RemoveBackend(rsID); err != nil {
-			log.Errorf("error while remove backend : %s", err)
-		}
-	}
-
-	// Stop the pulse goroutine.
-	rs.monitor.Stop()
-
+	// IPVS goes first, so that the backend is left intact if it fails.
 	if err := ctx.ipvs.DelDestPort(
 		rs.service.options.host.String(),
 		rs.service.options.Port,
 		rs.options.host.String(),
 		rs.options.Port,
 		rs.service.options.Protocol,
+		rs.service.options.FwMark,
 	); err != nil {
 		log.Errorf("error while removing backend [%s/%s]", vsID, rsID)
 		return nil, ErrIpvsSyscallFailed
 	}
 
+	// delete backend from external store
+	if ctx.store != nil {
+		if err := ctx.store.RemoveBackend(rsID); err != nil {
+			log.Errorf("error while remove backend : %s", err)
+		}
+	}
+
+	// Stop the pulse goroutine.
+	rs.monitor.Stop()
+
 	delete(ctx.backends, rsID)
 
+	// Removing the last healthy backend has to bring the fallback backend in.
+	ctx.refreshFallback(vsID, rs.service)
+
 	return rs.options, nil
 }
 
@@ -517,6 +766,9 @@ type ServiceInfo struct {
 	Options  *ServiceOptions `json:"options"`
 	Health   float64         `json:"health"`
 	Backends []string        `json:"backends"`
+	Stats    *Stats          `json:"stats,omitempty"`
+	Panic    bool            `json:"panic"`
+	Fallback bool            `json:"fallback_active"`
 }
 
 // GetService returns information about a virtual service.
@@ -530,7 +782,7 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 		return nil, ErrObjectNotFound
 	}
 
-	result := ServiceInfo{Options: vs.options}
+	result := ServiceInfo{Options: vs.options, Panic: vs.panic, Fallback: vs.fallback}
 
 	// This is O(n), can be optimized with reverse backend map.
 	for rsID, backend := range ctx.backends {
@@ -549,13 +801,41 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 		result.Health /= float64(len(result.Backends))
 	}
 
+	if stats, err := ctx.serviceStats(vs); err != nil {
+		log.Errorf("error while reading stats of virtual service [%s]: %s", vsID, err)
+	} else {
+		result.Stats = stats
+	}
+
 	return &result, nil
 }
 
+// GetBackendOptions returns a copy of the backend options, e.g. to be patched.
+func (ctx *Context) GetBackendOptions(vsID, rsID string) (*BackendOptions, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	rs, exists := ctx.backends[rsID]
+
+	if !exists {
+		return nil, ErrObjectNotFound
+	}
+
+	// The configured weight is returned, not the current one of a stashed,
+	// recovering or drained backend.
+	opts := rs.options.Copy()
+	opts.Weight = rs.weight
+
+	return opts, nil
+}
+
 // BackendInfo contains information about backend options and pulse.
 type BackendInfo struct {
-	Options *BackendOptions `json:"options"`
-	Metrics pulse.Metrics   `json:"metrics"`
+	Options  *BackendOptions `json:"options"`
+	Metrics  pulse.Metrics   `json:"metrics"`
+	Stats    *Stats          `json:"stats,omitempty"`
+	Drain    *DrainInfo      `json:"drain,omitempty"`
+	Ejection *EjectionInfo   `json:"ejection,omitempty"`
 }
 
 // GetBackend returns information about a backend.
@@ -569,7 +849,25 @@ func (ctx *Context) GetBackend(vsID, rsID string) (*BackendInfo, error) {
 		return nil, ErrObjectNotFound
 	}
 
-	return &BackendInfo{rs.options, rs.metrics}, nil
+	result := BackendInfo{Options: rs.options, Metrics: rs.metrics}
+
+	if rs.drain != nil {
+		drain := *rs.drain
+		result.Drain = &drain
+	}
+
+	if rs.ejection != nil {
+		ejection := *rs.ejection
+		result.Ejection = &ejection
+	}
+
+	if stats, err := ctx.backendStats(rs); err != nil {
+		log.Errorf("error while reading stats of backend [%s/%s]: %s", vsID, rsID, err)
+	} else {
+		result.Stats = stats
+	}
+
+	return &result, nil
 }
 
 // if external kvstore exists, set store to context
@@ -590,9 +888,10 @@ func (ctx *Context) Synchronize(storeServices map[string]*ServiceOptions, storeB
 	}
 	defer log.Debugf("============================================================================")
 
-	// synchronize services with store
-	for id, _ := range ctx.services {
-		if _, ok := storeServices[id]; !ok {
+	// synchronize services with store, adopted services are removed only after
+	// they had a chance to be claimed by store services with the same endpoints.
+	for id, service := range ctx.services {
+		if _, ok := storeServices[id]; !ok && !service.adopted {
 			ctx.removeService(id)
 		}
 	}
@@ -605,10 +904,15 @@ func (ctx *Context) Synchronize(storeServices map[string]*ServiceOptions, storeB
 		}
 		ctx.createService(id, storeServiceOptions)
 	}
+	for id, service := range ctx.services {
+		if _, ok := storeServices[id]; !ok && service.adopted {
+			ctx.removeService(id)
+		}
+	}
 
-	// synchronize backends with store
+	// synchronize backends with store, the same way as services
 	for id, backend := range ctx.backends {
-		if _, ok := storeBackends[id]; !ok {
+		if _, ok := storeBackends[id]; !ok && !backend.adopted {
 			vsID := "(unknown)"
 			if len(backend.options.VsID) > 0 {
 				vsID = backend.options.VsID
@@ -627,4 +931,9 @@ func (ctx *Context) Synchronize(storeServices map[string]*ServiceOptions, storeB
 			log.Warnf("create backend error: %s", err.Error())
 		}
 	}
+	for id, backend := range ctx.backends {
+		if _, ok := storeBackends[id]; !ok && backend.adopted {
+			ctx.removeBackend(backend.options.VsID, id)
+		}
+	}
 }
@@ -1,7 +1,12 @@
 package core
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
 	"testing"
+	"time"
 
 	"strings"
 
@@ -44,36 +49,61 @@ func (f *fakeIpvs) Flush() error {
 	return args.Error(0)
 }
 
-func (f *fakeIpvs) AddService(vip string, port uint16, protocol string, sched string, flags []string) error {
-	args := f.Called(vip, port, protocol, sched, flags)
+func (f *fakeIpvs) AddService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error {
+	args := f.Called(vip, port, protocol, fwmark, sched, flags, timeout, netmask)
 	return args.Error(0)
 }
 
-func (f *fakeIpvs) UpdateService(vip string, port uint16, protocol string, sched string, flags []string) error {
-	args := f.Called(vip, port, protocol, sched, flags)
+func (f *fakeIpvs) UpdateService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error {
+	args := f.Called(vip, port, protocol, fwmark, sched, flags, timeout, netmask)
 	return args.Error(0)
 }
 
-func (f *fakeIpvs) DelService(vip string, port uint16, protocol string) error {
-	args := f.Called(vip, port, protocol)
+func (f *fakeIpvs) DelService(vip string, port uint16, protocol string, fwmark uint32) error {
+	args := f.Called(vip, port, protocol, fwmark)
 	return args.Error(0)
 }
 
-func (f *fakeIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error {
-	args := f.Called(vip, vport, rip, rport, protocol, weight, fwd)
+func (f *fakeIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error {
+	args := f.Called(vip, vport, rip, rport, protocol, fwmark, weight, fwd)
 	return args.Error(0)
 }
 
-func (f *fakeIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error {
-	args := f.Called(vip, vport, rip, rport, protocol, weight, fwd)
+func (f *fakeIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error {
+	args := f.Called(vip, vport, rip, rport, protocol, fwmark, weight, fwd)
 	return args.Error(0)
 
 }
-func (f *fakeIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string) error {
-	args := f.Called(vip, vport, rip, rport, protocol)
+func (f *fakeIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32) error {
+	args := f.Called(vip, vport, rip, rport, protocol, fwmark)
 	return args.Error(0)
 }
 
+func (f *fakeIpvs) ListServices() ([]*ipvs_shim.Service, error) {
+	args := f.Called()
+	return args.Get(0).([]*ipvs_shim.Service), args.Error(1)
+}
+
+func (f *fakeIpvs) ListServicesWithDestinations() ([]*ipvs_shim.Service, error) {
+	args := f.Called()
+	return args.Get(0).([]*ipvs_shim.Service), args.Error(1)
+}
+
+func (f *fakeIpvs) GetService(vip string, port uint16, protocol string, fwmark uint32) (*ipvs_shim.Service, error) {
+	args := f.Called(vip, port, protocol, fwmark)
+	return args.Get(0).(*ipvs_shim.Service), args.Error(1)
+}
+
+func (f *fakeIpvs) ListDestinations(vip string, port uint16, protocol string, fwmark uint32) ([]*ipvs_shim.Destination, error) {
+	args := f.Called(vip, port, protocol, fwmark)
+	return args.Get(0).([]*ipvs_shim.Destination), args.Error(1)
+}
+
+func (f *fakeIpvs) ListConnections() ([]*ipvs_shim.Connection, error) {
+	args := f.Called()
+	return args.Get(0).([]*ipvs_shim.Connection), args.Error(1)
+}
+
 func newRoutineContext(backends map[string]*backend, ipvs ipvs_shim.IPVS) *Context {
 	c := newContext(ipvs, &fakeDisco{})
 	c.backends = backends
@@ -103,7 +133,7 @@ func TestServiceIsCreated(t *testing.T) {
 	mockDisco := &fakeDisco{}
 	c := newContext(mockIpvs, mockDisco)
 
-	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", "sh", []string(nil)).Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "sh", []string(nil), uint32(0), uint8(0)).Return(nil)
 	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
 
 	err := c.createService(vsID, options)
@@ -118,8 +148,8 @@ func TestServiceIsCreatedWithShFlags(t *testing.T) {
 	mockDisco := &fakeDisco{}
 	c := newContext(mockIpvs, mockDisco)
 
-	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", "sh",
-		strings.Split(options.Flags, "|")).Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "sh",
+		strings.Split(options.Flags, "|"), uint32(0), uint8(0)).Return(nil)
 	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
 
 	err := c.createService(vsID, options)
@@ -134,8 +164,25 @@ func TestServiceIsCreatedWithGenericCustomFlags(t *testing.T) {
 	mockDisco := &fakeDisco{}
 	c := newContext(mockIpvs, mockDisco)
 
-	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", "sh",
-		strings.Split(options.Flags, "|")).Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "sh",
+		strings.Split(options.Flags, "|"), uint32(0), uint8(0)).Return(nil)
+	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+
+	err := c.createService(vsID, options)
+	assert.NoError(t, err)
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestPersistentServiceIsCreated(t *testing.T) {
+	options := &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", Method: "rr", Persistent: true,
+		PersistenceTimeout: "10m", PersistenceNetmask: 24}
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "rr", []string(nil),
+		uint32(600), uint8(24)).Return(nil)
 	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
 
 	err := c.createService(vsID, options)
@@ -151,8 +198,10 @@ func TestServiceIsUpdated(t *testing.T) {
 	mockDisco := &fakeDisco{}
 	c := newContext(mockIpvs, mockDisco)
 
-	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", "sh", []string{"flag-1"}).Return(nil)
-	mockIpvs.On("UpdateService", "127.0.0.1", uint16(80), "tcp", "rr", []string{"flag-2"}).Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "sh", []string{"flag-1"},
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("UpdateService", "127.0.0.1", uint16(80), "tcp", uint32(0), "rr", []string{"flag-2"},
+		uint32(0), uint8(0)).Return(nil)
 	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
 
 	err := c.createService(vsID, options)
@@ -189,8 +238,8 @@ func TestCannotUpdateServiceIfHostPortProtocolChange(t *testing.T) {
 			mockDisco := &fakeDisco{}
 			c := newContext(mockIpvs, mockDisco)
 
-			mockIpvs.On("AddService", options.Host, options.Port, options.Protocol, options.Method,
-				[]string{options.Flags}).Return(nil)
+			mockIpvs.On("AddService", options.Host, options.Port, options.Protocol, uint32(0), options.Method,
+				[]string{options.Flags}, uint32(0), uint8(0)).Return(nil)
 			mockDisco.On("Expose", vsID, options.Host, options.Port).Return(nil)
 
 			err := c.createService(vsID, options)
@@ -210,7 +259,7 @@ func TestServiceIsCreatedIfDoesntExist(t *testing.T) {
 	mockDisco := &fakeDisco{}
 	c := newContext(mockIpvs, mockDisco)
 
-	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", "sh", []string(nil)).Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), "tcp", uint32(0), "sh", []string(nil), uint32(0), uint8(0)).Return(nil)
 	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
 
 	err := c.updateService(vsID, options)
@@ -226,7 +275,7 @@ func TestPulseUpdateSetsBackendWeightToZeroOnStatusDown(t *testing.T) {
 
 	c := newRoutineContext(backends, mockIpvs)
 
-	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(0), mock.Anything).Return(nil)
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(0), mock.Anything).Return(nil)
 
 	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusDown}})
 	assert.Equal(t, len(stash), 1)
@@ -241,7 +290,7 @@ func TestPulseUpdateIncreasesBackendWeightRelativeToTheHealthOnStatusUp(t *testi
 
 	c := newRoutineContext(backends, mockIpvs)
 
-	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(6), mock.Anything).Return(nil)
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(6), mock.Anything).Return(nil)
 
 	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
 	assert.Equal(t, len(stash), 1)
@@ -256,7 +305,7 @@ func TestPulseUpdateRemovesStashWhenBackendHasFullyRecovered(t *testing.T) {
 
 	c := newRoutineContext(backends, mockIpvs)
 
-	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(12), mock.Anything).Return(nil)
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(12), mock.Anything).Return(nil)
 
 	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
 	assert.Empty(t, stash)
@@ -286,3 +335,962 @@ func TestPulseUpdateRemovesStashWhenDeletedAfterNotification(t *testing.T) {
 	assert.Empty(t, stash)
 	mockIpvs.AssertExpectations(t)
 }
+
+func TestIPv6ServiceAndBackendAreCreated(t *testing.T) {
+	options := &ServiceOptions{Port: 80, Host: "fd11:bcb5:61df::1", Protocol: "tcp", Method: "rr"}
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddService", "fd11:bcb5:61df::1", uint16(80), "tcp", uint32(0), "rr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("AddDestPort", "fd11:bcb5:61df::1", uint16(80), "fd11:bcb5:61df::2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockDisco.On("Expose", vsID, "fd11:bcb5:61df::1", uint16(80)).Return(nil)
+
+	err := c.createService(vsID, options)
+	assert.NoError(t, err)
+
+	err = c.createBackend(vsID, rsID, &BackendOptions{Host: "fd11:bcb5:61df::2", Port: 8080,
+		Pulse: &pulse.Options{Type: "none"}})
+	assert.NoError(t, err)
+
+	// Mixing address families within a service is not allowed.
+	err = c.createBackend(vsID, "v4-backend", &BackendOptions{Host: "10.0.0.2", Port: 8080})
+	assert.Equal(t, ErrIncompatibleAFs, err)
+
+	close(c.stopCh)
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestVIPAddrUsesHostMask(t *testing.T) {
+	v4 := vipAddr(net.ParseIP("10.0.0.1"))
+	assert.Equal(t, "10.0.0.1/32", v4.IPNet.String())
+
+	v6 := vipAddr(net.ParseIP("fd11:bcb5:61df::1"))
+	assert.Equal(t, "fd11:bcb5:61df::1/128", v6.IPNet.String())
+	assert.Equal(t, ifaFlagNoDAD, v6.Flags)
+}
+
+func TestFwMarkServiceInstallsAndRemovesMarkRule(t *testing.T) {
+	options := &ServiceOptions{Port: 80, Host: "10.0.0.1", Protocol: "tcp", Method: "rr", FwMark: 7,
+		FwMarkPorts: "80,443"}
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	var rules [][]string
+	defer func(fn func(int, ...string) error) { iptables = fn }(iptables)
+	iptables = func(family int, args ...string) error {
+		rules = append(rules, args)
+		return nil
+	}
+
+	mockIpvs.On("AddService", "10.0.0.1", uint16(80), "tcp", uint32(7), "rr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("DelService", "10.0.0.1", uint16(80), "tcp", uint32(7)).Return(nil)
+	mockDisco.On("Expose", vsID, "10.0.0.1", uint16(80)).Return(nil)
+	mockDisco.On("Remove", vsID).Return(nil)
+
+	err := c.createService(vsID, options)
+	assert.NoError(t, err)
+	_, err = c.removeService(vsID)
+	assert.NoError(t, err)
+
+	rule := []string{"PREROUTING", "-d", "10.0.0.1", "-p", "tcp", "-m", "multiport", "--dports", "80,443",
+		"-m", "comment", "--comment", "gorb:" + vsID, "-j", "MARK", "--set-mark", "7"}
+	assert.Equal(t, [][]string{
+		append([]string{"-w", "-t", "mangle", "-A"}, rule...),
+		append([]string{"-w", "-t", "mangle", "-D"}, rule...),
+	}, rules)
+
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestBackendPortIsOptionalForFwMarkServices(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	c.services["plain"] = &service{options: &ServiceOptions{Port: 80, Protocol: "tcp",
+		host: net.ParseIP("10.0.0.1")}}
+	c.services["marked"] = &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", FwMark: 7,
+		host: net.ParseIP("10.0.0.1")}}
+
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(0), "tcp",
+		uint32(7), uint32(100), "nat").Return(nil)
+
+	err := c.createBackend("plain", "rs-plain", &BackendOptions{Host: "10.0.0.2",
+		Pulse: &pulse.Options{Type: "none"}})
+	assert.Equal(t, ErrMissingEndpoint, err)
+
+	err = c.createBackend("marked", "rs-marked", &BackendOptions{Host: "10.0.0.2",
+		Pulse: &pulse.Options{Type: "none"}})
+	assert.NoError(t, err)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestSCTPBackendsDefaultToSCTPPulse(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 2905, Protocol: "sctp",
+		host: net.ParseIP("10.0.0.1")}}
+
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(2905), "10.0.0.2", uint16(2905), "sctp",
+		uint32(0), uint32(100), "nat").Return(nil)
+
+	options := &BackendOptions{Host: "10.0.0.2", Port: 2905}
+	err := c.createBackend(vsID, rsID, options)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sctp", options.Pulse.Type)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestAdoptImportsExistingServices(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	mockIpvs.On("ListServices").Return([]*ipvs_shim.Service{
+		{VIP: "10.0.0.1", Port: 80, Protocol: "tcp", Family: 2, Sched: "wrr", Timeout: 60, Netmask: 24},
+		{Port: 0, FwMark: 7, Family: 10, Sched: "rr"},
+	}, nil)
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080, Weight: 50, Fwd: "nat"}}, nil)
+	mockIpvs.On("ListDestinations", "::", uint16(0), "tcp", uint32(7)).Return(
+		[]*ipvs_shim.Destination{}, nil)
+
+	assert.NoError(t, c.adopt())
+
+	vs := c.services["10.0.0.1-80-tcp"]
+	if assert.NotNil(t, vs) {
+		assert.True(t, vs.adopted)
+		assert.True(t, vs.options.Persistent)
+		assert.Equal(t, "60s", vs.options.PersistenceTimeout)
+		assert.Equal(t, uint8(24), vs.options.PersistenceNetmask)
+	}
+	assert.NotNil(t, c.services["fwmark-7-ipv6"])
+
+	rs := c.backends["10.0.0.1-80-tcp-10.0.0.2-8080"]
+	if assert.NotNil(t, rs) {
+		assert.True(t, rs.adopted)
+		assert.Equal(t, vs, rs.service)
+		assert.Equal(t, uint32(50), rs.options.Weight)
+	}
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestAdoptedServiceAndBackendAreClaimed(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+	defer close(c.stopCh)
+
+	mockIpvs.On("ListServices").Return([]*ipvs_shim.Service{
+		{VIP: "10.0.0.1", Port: 80, Protocol: "tcp", Family: 2, Sched: "wrr"},
+	}, nil)
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080, Weight: 50, Fwd: "nat"}}, nil)
+	assert.NoError(t, c.adopt())
+
+	// Existing entries are updated rather than created again.
+	mockIpvs.On("UpdateService", "10.0.0.1", uint16(80), "tcp", uint32(0), "rr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockDisco.On("Expose", vsID, "10.0.0.1", uint16(80)).Return(nil)
+
+	err := c.createService(vsID, &ServiceOptions{Host: "10.0.0.1", Port: 80, Method: "rr"})
+	assert.NoError(t, err)
+	err = c.createBackend(vsID, rsID, &BackendOptions{Host: "10.0.0.2", Port: 8080,
+		Pulse: &pulse.Options{Type: "none"}})
+	assert.NoError(t, err)
+
+	assert.Len(t, c.services, 1)
+	assert.Len(t, c.backends, 1)
+	assert.False(t, c.services[vsID].adopted)
+	assert.False(t, c.backends[rsID].adopted)
+	assert.Equal(t, c.services[vsID], c.backends[rsID].service)
+	assert.Equal(t, vsID, c.backends[rsID].options.VsID)
+
+	// The replaced placeholder pulse doesn't report the backend as removed.
+	select {
+	case u := <-c.pulseCh:
+		assert.NotEqual(t, pulse.StatusRemoved, u.Metrics.Status)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestDriftIsDetectedAndRepaired(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", Method: "wrr", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	c.backends[rsID] = &backend{service: vs, options: &BackendOptions{Port: 8080, Weight: 100, Method: "nat",
+		host: net.ParseIP("10.0.0.2")}}
+	c.backends["missing"] = &backend{service: vs, options: &BackendOptions{Port: 8080, Weight: 100,
+		Method: "nat", host: net.ParseIP("10.0.0.3")}}
+
+	mockIpvs.On("ListServices").Return([]*ipvs_shim.Service{
+		{VIP: "10.0.0.1", Port: 80, Protocol: "tcp", Family: 2, Sched: "rr"},
+		{VIP: "10.0.0.9", Port: 53, Protocol: "udp", Family: 2, Sched: "wrr"},
+	}, nil)
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{
+			{Host: "10.0.0.2", Port: 8080, Weight: 0, Fwd: "nat"},
+			{Host: "10.0.0.4", Port: 8080, Weight: 100, Fwd: "nat"},
+		}, nil)
+
+	mockIpvs.On("UpdateService", "10.0.0.1", uint16(80), "tcp", uint32(0), "wrr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("DelService", "10.0.0.9", uint16(53), "udp", uint32(0)).Return(nil)
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.3", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockIpvs.On("DelDestPort", "10.0.0.1", uint16(80), "10.0.0.4", uint16(8080), "tcp",
+		uint32(0)).Return(nil)
+
+	report, err := c.checkDrift(true)
+	assert.NoError(t, err)
+	assert.True(t, report.Repaired)
+
+	kinds := make(map[string]int)
+	for _, d := range report.Drifts {
+		kinds[d.Kind]++
+	}
+	assert.Equal(t, map[string]int{
+		DriftServiceMismatch: 1,
+		DriftUnknownService:  1,
+		DriftMissingBackend:  1,
+		DriftBackendMismatch: 1,
+		DriftUnknownBackend:  1,
+	}, kinds)
+	assert.Equal(t, report, c.drift)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestMissingServiceIsRestoredWithBackends(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", Method: "wrr", host: net.ParseIP("10.0.0.1"),
+		Fallback: &BackendOptions{Port: 8080, Weight: 100, Method: "nat", host: net.ParseIP("10.0.0.9")}},
+		fallback: true}
+	c.services[vsID] = vs
+	c.backends[rsID] = &backend{service: vs, options: &BackendOptions{Port: 8080, Weight: 100, Method: "nat",
+		host: net.ParseIP("10.0.0.2")}}
+	c.backends["drained"] = &backend{service: vs, options: &BackendOptions{Port: 8080, Weight: 100, Method: "nat",
+		host: net.ParseIP("10.0.0.3")}, drain: &DrainInfo{}}
+
+	mockIpvs.On("ListServices").Return([]*ipvs_shim.Service{}, nil)
+
+	report, err := c.checkDrift(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Drift{{Kind: DriftMissingService, VsID: vsID, Endpoint: "10.0.0.1:80/tcp"}}, report.Drifts)
+
+	mockIpvs.On("AddService", "10.0.0.1", uint16(80), "tcp", uint32(0), "wrr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.3", uint16(8080), "tcp",
+		uint32(0), uint32(0), "nat").Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.9", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+
+	report, err = c.checkDrift(true)
+	assert.NoError(t, err)
+	assert.True(t, report.Repaired)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestFailedDriftRepairIsReported(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	mockIpvs.On("ListServices").Return([]*ipvs_shim.Service{
+		{VIP: "10.0.0.9", Port: 53, Protocol: "udp", Family: 2, Sched: "wrr"},
+	}, nil)
+	mockIpvs.On("DelService", "10.0.0.9", uint16(53), "udp", uint32(0)).Return(errors.New("busy"))
+
+	report, err := c.checkDrift(true)
+	assert.NoError(t, err)
+	assert.False(t, report.Repaired)
+	assert.Len(t, report.Drifts, 1)
+	assert.Equal(t, "busy", report.Drifts[0].Error)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestServiceAndBackendInfoIncludeStats(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	c.backends[rsID] = &backend{service: vs, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.2")}}
+	c.backends["other"] = &backend{service: vs, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.3")}}
+
+	mockIpvs.On("GetService", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		&ipvs_shim.Service{Stats: ipvs_shim.Stats{Connections: 30, BytesIn: 1024}}, nil)
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{
+			{Host: "10.0.0.2", Port: 8080, ActiveConns: 2, InactiveConns: 1,
+				Stats: ipvs_shim.Stats{Connections: 20}},
+			{Host: "10.0.0.3", Port: 8080, ActiveConns: 3, Stats: ipvs_shim.Stats{Connections: 10}},
+		}, nil)
+
+	info, err := c.GetService(vsID)
+	assert.NoError(t, err)
+	assert.Equal(t, &Stats{ActiveConns: 5, InactiveConns: 1,
+		Stats: ipvs_shim.Stats{Connections: 30, BytesIn: 1024}}, info.Stats)
+
+	rsInfo, err := c.GetBackend(vsID, rsID)
+	assert.NoError(t, err)
+	assert.Equal(t, &Stats{ActiveConns: 2, InactiveConns: 1, Stats: ipvs_shim.Stats{Connections: 20}},
+		rsInfo.Stats)
+}
+
+func TestConnectionsAreFilteredAndPaginated(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	c.backends[rsID] = &backend{service: vs, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.2")}}
+	c.backends["other"] = &backend{service: vs, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.3")}}
+
+	mockIpvs.On("ListConnections").Return([]*ipvs_shim.Connection{
+		{Protocol: "tcp", Client: "192.168.0.3", ClientPort: 1000, VIP: "10.0.0.1", VPort: 80,
+			Dest: "10.0.0.2", DPort: 8080, State: "ESTABLISHED"},
+		{Protocol: "tcp", Client: "192.168.0.1", ClientPort: 1000, VIP: "10.0.0.1", VPort: 80,
+			Dest: "10.0.0.2", DPort: 8080, State: "FIN_WAIT"},
+		{Protocol: "tcp", Client: "192.168.0.2", ClientPort: 1000, VIP: "10.0.0.1", VPort: 80,
+			Dest: "10.0.0.3", DPort: 8080, State: "ESTABLISHED"},
+		{Protocol: "tcp", Client: "172.16.0.1", ClientPort: 1000, VIP: "10.0.0.1", VPort: 80,
+			Dest: "10.0.0.2", DPort: 8080, State: "ESTABLISHED"},
+		// Different service.
+		{Protocol: "udp", Client: "192.168.0.1", ClientPort: 1000, VIP: "10.0.0.1", VPort: 80,
+			Dest: "10.0.0.2", DPort: 8080, State: "UDP"},
+	}, nil).Run(func(mock.Arguments) {
+		// The connection table is read without holding the mutex.
+		c.mutex.Lock()
+		c.mutex.Unlock()
+	})
+
+	list, err := c.ListConnections(vsID, "", ConnectionFilter{Client: "192.168.0.0/24", Offset: 1, Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, list.Total)
+	assert.Equal(t, []Connection{{Protocol: "tcp", Client: "192.168.0.2:1000", VIP: "10.0.0.1:80",
+		Backend: "10.0.0.3:8080", RsID: "other", State: "ESTABLISHED", Expires: "0s"}}, list.Connections)
+
+	list, err = c.ListConnections(vsID, rsID, ConnectionFilter{State: "established"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, list.Total)
+	assert.Equal(t, "172.16.0.1:1000", list.Connections[0].Client)
+	assert.Equal(t, "192.168.0.3:1000", list.Connections[1].Client)
+
+	list, err = c.ListConnections(vsID, "", ConnectionFilter{Offset: 1, Limit: int(^uint(0) >> 1)})
+	assert.NoError(t, err)
+	assert.Len(t, list.Connections, list.Total-1)
+
+	_, err = c.ListConnections(vsID, "", ConnectionFilter{Client: "nonsense"})
+	assert.Equal(t, ErrInvalidClientFilter, err)
+	_, err = c.ListConnections(vsID, "missing", ConnectionFilter{})
+	assert.Equal(t, ErrObjectNotFound, err)
+}
+
+func TestBackendIsRemovedOnceDrained(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	defer func(interval time.Duration) { drainCheckInterval = interval }(drainCheckInterval)
+	drainCheckInterval = time.Millisecond
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	monitor, _ := pulse.New("10.0.0.2", 8080, &pulse.Options{Type: "none"})
+	c.backends[rsID] = &backend{service: vs, monitor: monitor, options: &BackendOptions{Port: 8080,
+		Weight: 100, Method: "nat", host: net.ParseIP("10.0.0.2")}}
+
+	removed := make(chan struct{})
+
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(0), "nat").Return(nil)
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080, ActiveConns: 1}}, nil).Once()
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080}}, nil)
+	mockIpvs.On("DelDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0)).Return(nil).Run(func(mock.Arguments) { close(removed) })
+
+	assert.Equal(t, ErrInvalidDrainTimeout, c.DrainBackend(vsID, rsID, 0))
+	assert.NoError(t, c.DrainBackend(vsID, rsID, time.Minute))
+	assert.Equal(t, ErrBackendDraining, c.DrainBackend(vsID, rsID, time.Minute))
+
+	_, err := c.UpdateBackend(vsID, rsID, 100)
+	assert.Equal(t, ErrBackendDraining, err)
+
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("backend hasn't been removed after draining")
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	assert.Empty(t, c.backends)
+}
+
+func TestFailedDrainedBackendRemovalIsRetried(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	monitor, _ := pulse.New("10.0.0.2", 8080, &pulse.Options{Type: "none"})
+	rs := &backend{service: vs, monitor: monitor, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.2")},
+		drain: &DrainInfo{Deadline: time.Now().Add(time.Minute)}}
+	c.backends[rsID] = rs
+
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080}}, nil)
+	mockIpvs.On("DelDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0)).Return(errors.New("busy")).Once()
+	mockIpvs.On("DelDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0)).Return(nil).Once()
+
+	// The backend is left intact and draining, with the error in its status.
+	assert.False(t, c.checkDrain(vsID, rsID, rs))
+	assert.Equal(t, rs, c.backends[rsID])
+	info, err := c.GetBackend(vsID, rsID)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrIpvsSyscallFailed.Error(), info.Drain.Error)
+
+	assert.True(t, c.checkDrain(vsID, rsID, rs))
+	assert.Empty(t, c.backends)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestBackendIsPatched(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	c.services[vsID] = &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(0), "tunnel").Return(nil)
+
+	err := c.createBackend(vsID, rsID, &BackendOptions{Host: "10.0.0.2", Port: 8080,
+		Pulse: &pulse.Options{Type: "none", Interval: "1m"}})
+	assert.NoError(t, err)
+	monitor := c.backends[rsID].monitor
+
+	opts, err := c.GetBackendOptions(vsID, rsID)
+	assert.NoError(t, err)
+	opts.Weight, opts.Method, opts.Pulse.Interval = 0, "tunnel", "10s"
+
+	// The copy is independent from the backend.
+	assert.Equal(t, "1m", c.backends[rsID].options.Pulse.Interval)
+
+	assert.NoError(t, c.PatchBackend(vsID, rsID, opts))
+	assert.Equal(t, opts, c.backends[rsID].options)
+	assert.NotEqual(t, monitor, c.backends[rsID].monitor)
+
+	opts = opts.Copy()
+	opts.Port = 9090
+	assert.Error(t, c.PatchBackend(vsID, rsID, opts))
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPatchedWeightOfStashedBackendIsRestored(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	backends := map[string]*backend{rsID: {service: vs, weight: 100, options: &BackendOptions{Weight: 100,
+		Host: "10.0.0.2", Port: 8080, Method: "nat", host: net.ParseIP("10.0.0.2"), Pulse: &pulse.Options{Type: "none"}}}}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(0), "nat").Return(nil).Twice()
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(50), "nat").Return(nil).Once()
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusDown}})
+
+	// The backend stays out of rotation while it's down.
+	opts := backends[rsID].options.Copy()
+	opts.Weight = 50
+	assert.NoError(t, c.PatchBackend(vsID, rsID, opts))
+	assert.Equal(t, uint32(0), backends[rsID].options.Weight)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, uint32(50), backends[rsID].options.Weight)
+	assert.Empty(t, stash)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPatchWithoutWeightKeepsConfiguredWeightOfStashedBackend(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	backends := map[string]*backend{rsID: {service: vs, weight: 100, options: &BackendOptions{Weight: 100,
+		Host: "10.0.0.2", Port: 8080, Method: "nat", host: net.ParseIP("10.0.0.2"), Pulse: &pulse.Options{Type: "none"}}}}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(0), "nat").Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(0), "tunnel").Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(100), "tunnel").Return(nil).Once()
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusDown}})
+
+	// Options to be patched carry the configured weight, not the stashed zero one.
+	opts, err := c.GetBackendOptions(vsID, rsID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(100), opts.Weight)
+
+	opts.Method = "tunnel"
+	assert.NoError(t, c.PatchBackend(vsID, rsID, opts))
+	assert.Equal(t, uint32(0), backends[rsID].options.Weight)
+	assert.Equal(t, uint32(100), backends[rsID].weight)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, uint32(100), backends[rsID].options.Weight)
+	assert.Empty(t, stash)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPatchedWeightOfRecoveringBackendIsRestored(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	backends := map[string]*backend{rsID: {service: vs, weight: 100, options: &BackendOptions{Weight: 100,
+		Host: "10.0.0.2", Port: 8080, Method: "nat", host: net.ParseIP("10.0.0.2"), Pulse: &pulse.Options{Type: "none"}}}}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(0), "nat").Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(50), "nat").Return(nil).Twice()
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(200), "nat").Return(nil).Once()
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusDown}})
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
+	assert.Equal(t, uint32(50), backends[rsID].options.Weight)
+
+	// The backend keeps recovering at its current weight, towards the new one.
+	opts, err := c.GetBackendOptions(vsID, rsID)
+	assert.NoError(t, err)
+	opts.Weight = 200
+	assert.NoError(t, c.PatchBackend(vsID, rsID, opts))
+	assert.Equal(t, uint32(50), backends[rsID].options.Weight)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID},
+		pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, uint32(200), backends[rsID].options.Weight)
+	assert.Empty(t, stash)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPassiveCheckEjectsBackends(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")}}
+	c.services[vsID] = vs
+	for i, id := range []string{rsID, "busy", "wedged"} {
+		c.backends[id] = &backend{service: vs, options: &BackendOptions{Port: 8080, Weight: 100,
+			Method: "nat", host: net.ParseIP(fmt.Sprintf("10.0.0.%d", i+2))}}
+	}
+
+	// Destinations are listed once per check, along with their services.
+	mockIpvs.On("ListServicesWithDestinations").Return([]*ipvs_shim.Service{{VIP: "10.0.0.1", Port: 80, Protocol: "tcp",
+		Destinations: []*ipvs_shim.Destination{
+			{Host: "10.0.0.2", Port: 8080, Weight: 100, Stats: ipvs_shim.Stats{Connections: 100, BytesOut: 1000}},
+			{Host: "10.0.0.3", Port: 8080, Weight: 100, Stats: ipvs_shim.Stats{Connections: 100, BytesOut: 1000}},
+			{Host: "10.0.0.4", Port: 8080, Weight: 100, Stats: ipvs_shim.Stats{Connections: 100, BytesOut: 1000}},
+		}}}, nil).Once()
+	mockIpvs.On("ListServicesWithDestinations").Return([]*ipvs_shim.Service{{VIP: "10.0.0.1", Port: 80, Protocol: "tcp",
+		Destinations: []*ipvs_shim.Destination{
+			// New connections, but no replies.
+			{Host: "10.0.0.2", Port: 8080, Weight: 100, Stats: ipvs_shim.Stats{Connections: 120, BytesOut: 1000}},
+			{Host: "10.0.0.3", Port: 8080, Weight: 100, ActiveConns: 20, InactiveConns: 30,
+				Stats: ipvs_shim.Stats{Connections: 150, BytesOut: 5000}},
+			// Mostly stuck connections.
+			{Host: "10.0.0.4", Port: 8080, Weight: 100, ActiveConns: 1, InactiveConns: 49,
+				Stats: ipvs_shim.Stats{Connections: 150, BytesOut: 2000}},
+		}}}, nil)
+
+	opts := PassiveOptions{InactiveRatio: 0.9, MinConns: 10, Ejection: time.Minute}
+
+	// The first sample is only a baseline.
+	assert.Empty(t, c.checkPassive(opts))
+
+	updates := c.checkPassive(opts)
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Source.RsID < updates[j].Source.RsID })
+	assert.Equal(t, []pulse.Update{
+		{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+		{Source: pulse.ID{VsID: vsID, RsID: "wedged"}, Metrics: pulse.Metrics{Status: pulse.StatusDown}},
+	}, updates)
+
+	mockIpvs.On("ListDestinations", "10.0.0.1", uint16(80), "tcp", uint32(0)).Return(
+		[]*ipvs_shim.Destination{{Host: "10.0.0.2", Port: 8080, Weight: 100}}, nil)
+	info, err := c.GetBackend(vsID, rsID)
+	assert.NoError(t, err)
+	assert.Equal(t, "no traffic sent for 20 new connections", info.Ejection.Reason)
+	assert.Nil(t, c.backends["busy"].ejection)
+	assert.Equal(t, "49 of 50 connections are inactive", c.backends["wedged"].ejection.Reason)
+
+	// Ejected backends are only checked again once the ejection expires.
+	assert.Empty(t, c.checkPassive(opts))
+
+	c.backends[rsID].ejection.Until = time.Now().Add(-time.Second)
+	assert.Empty(t, c.checkPassive(opts))
+	assert.Nil(t, c.backends[rsID].ejection)
+
+	mockIpvs.AssertNumberOfCalls(t, "ListServicesWithDestinations", 4)
+	mockIpvs.AssertNumberOfCalls(t, "ListDestinations", 1)
+}
+
+func TestPulseUpdateKeepsEjectedBackendDown(t *testing.T) {
+	stash := make(map[pulse.ID]uint32)
+	backends := map[string]*backend{rsID: {service: &virtualService, options: &BackendOptions{Weight: 100},
+		ejection: &EjectionInfo{Until: time.Now().Add(time.Minute)}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(0), mock.Anything).Return(nil)
+
+	c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, uint32(100), stash[pulse.ID{VsID: vsID, RsID: rsID}])
+	assert.Equal(t, pulse.StatusDown, backends[rsID].metrics.Status)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestRecoveryWeight(t *testing.T) {
+	tests := []struct {
+		options ServiceOptions
+		elapsed time.Duration
+		weight  uint32
+	}{
+		{ServiceOptions{Recovery: RecoveryHealth}, time.Hour, 50},
+		{ServiceOptions{}, time.Hour, 50},
+		{ServiceOptions{Recovery: RecoveryImmediate}, 0, 100},
+		{ServiceOptions{Recovery: RecoveryLinear, recoveryPeriod: time.Minute}, 0, 1},
+		{ServiceOptions{Recovery: RecoveryLinear, recoveryPeriod: time.Minute}, 15 * time.Second, 25},
+		{ServiceOptions{Recovery: RecoveryLinear, recoveryPeriod: time.Minute}, time.Hour, 100},
+		{ServiceOptions{Recovery: RecoveryExponential, recoveryPeriod: time.Minute}, 0, 1},
+		{ServiceOptions{Recovery: RecoveryExponential, recoveryPeriod: time.Minute}, 30 * time.Second, 10},
+		{ServiceOptions{Recovery: RecoveryExponential, recoveryPeriod: time.Minute}, time.Minute, 100},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.weight, recoveryWeight(&test.options, 100, 0.5, test.elapsed),
+			"%s after %s", test.options.Recovery, test.elapsed)
+	}
+
+	assert.Zero(t, recoveryWeight(&ServiceOptions{Recovery: RecoveryLinear, recoveryPeriod: time.Minute}, 0, 1, 0))
+}
+
+func TestPulseUpdateRampsUpRecoveringBackend(t *testing.T) {
+	stash := map[pulse.ID]uint32{pulse.ID{VsID: vsID, RsID: rsID}: uint32(100)}
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", Recovery: RecoveryLinear,
+		recoveryPeriod: time.Minute}}
+	backends := map[string]*backend{rsID: {service: vs, options: &BackendOptions{}}}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(1), mock.Anything).Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(50), mock.Anything).Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(100), mock.Anything).Return(nil).Once()
+
+	update := pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 0.1}}
+
+	c.processPulseUpdate(stash, update)
+	assert.Len(t, stash, 1)
+
+	backends[rsID].upSince = backends[rsID].upSince.Add(-30 * time.Second)
+	c.processPulseUpdate(stash, update)
+	assert.Len(t, stash, 1)
+
+	backends[rsID].upSince = backends[rsID].upSince.Add(-30 * time.Second)
+	c.processPulseUpdate(stash, update)
+	assert.Empty(t, stash)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPulseUpdateScalesWeightsByLatency(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", LatencyWeighting: true}}
+	fast := &backend{service: vs, weight: 100, options: &BackendOptions{Weight: 100, Pulse: &pulse.Options{Type: "tcp"}},
+		metrics: pulse.Metrics{Status: pulse.StatusUp, LatencyP50: 10 * time.Millisecond}}
+	slow := &backend{service: vs, weight: 100, options: &BackendOptions{Weight: 100, Pulse: &pulse.Options{Type: "tcp"}}}
+	backends := map[string]*backend{"fast": fast, rsID: slow}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(backends, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(25), mock.Anything).Return(nil).Once()
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, uint32(100), mock.Anything).Return(nil).Once()
+
+	update := pulse.Update{pulse.ID{VsID: vsID, RsID: rsID}, pulse.Metrics{Status: pulse.StatusUp, Health: 1,
+		LatencyP50: 40 * time.Millisecond}}
+	c.processPulseUpdate(map[pulse.ID]uint32{}, update)
+	assert.Equal(t, uint32(25), slow.ipvsWeight())
+
+	// The configured weight is kept.
+	assert.Equal(t, uint32(100), slow.options.Weight)
+
+	// Small changes are ignored.
+	update.Metrics.LatencyP50 = 38 * time.Millisecond
+	c.processPulseUpdate(map[pulse.ID]uint32{}, update)
+	assert.Equal(t, uint32(25), slow.ipvsWeight())
+
+	update.Metrics.LatencyP50 = 10 * time.Millisecond
+	c.processPulseUpdate(map[pulse.ID]uint32{}, update)
+	assert.Equal(t, uint32(100), slow.ipvsWeight())
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPanicModeKeepsUnhealthyBackends(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", MinHealthy: 2}}
+	backends := map[string]*backend{}
+	for i, id := range []string{"a", "b", "c"} {
+		backends[id] = &backend{service: vs, options: &BackendOptions{Weight: 100, Port: 8080,
+			host: net.ParseIP(fmt.Sprintf("10.0.0.%d", i+2))}}
+	}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	update := func(id string, status pulse.StatusType) {
+		c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: id}, pulse.Metrics{Status: status, Health: 1}})
+	}
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(0), mock.Anything).Return(nil).Twice()
+	mockIpvs.On("UpdateDestPort", mock.Anything, uint16(80), "10.0.0.2", uint16(8080), "tcp", uint32(0),
+		uint32(100), mock.Anything).Return(nil).Once()
+
+	// Enough healthy backends left.
+	update("a", pulse.StatusDown)
+	assert.Contains(t, stash, pulse.ID{VsID: vsID, RsID: "a"})
+	assert.False(t, vs.panic)
+
+	// Unhealthy backends are restored instead of removing another one.
+	update("b", pulse.StatusDown)
+	assert.Empty(t, stash)
+	assert.True(t, vs.panic)
+	assert.Equal(t, uint32(100), backends["b"].options.Weight)
+
+	mockIpvs.On("GetService", mock.Anything, uint16(80), "tcp", uint32(0)).Return((*ipvs_shim.Service)(nil),
+		errors.New("no stats"))
+
+	info, err := c.GetService(vsID)
+	assert.NoError(t, err)
+	assert.True(t, info.Panic)
+
+	// Once enough backends are healthy, the unhealthy ones are removed again.
+	update("b", pulse.StatusUp)
+	assert.False(t, vs.panic)
+	assert.Equal(t, map[pulse.ID]uint32{pulse.ID{VsID: vsID, RsID: "a"}: 100}, stash)
+	assert.Equal(t, uint32(0), backends["a"].options.Weight)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestFallbackBackend(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp",
+		Fallback: &BackendOptions{Port: 8080, Weight: 100, Method: "nat", host: net.ParseIP("10.0.0.9")}}}
+	backends := map[string]*backend{
+		"a": {service: vs, options: &BackendOptions{Weight: 100, Port: 8080, host: net.ParseIP("10.0.0.2")}},
+		"b": {service: vs, options: &BackendOptions{Weight: 100, Port: 8080, host: net.ParseIP("10.0.0.3")}},
+	}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	update := func(id string, status pulse.StatusType) {
+		c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: id}, pulse.Metrics{Status: status, Health: 1}})
+	}
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, uint16(80), mock.Anything, uint16(8080), "tcp", uint32(0),
+		mock.Anything, mock.Anything).Return(nil)
+	mockIpvs.On("AddDestPort", mock.Anything, uint16(80), "10.0.0.9", uint16(8080), "tcp", uint32(0),
+		uint32(100), "nat").Return(nil).Once()
+	mockIpvs.On("DelDestPort", mock.Anything, uint16(80), "10.0.0.9", uint16(8080), "tcp", uint32(0)).
+		Return(nil).Once()
+
+	update("a", pulse.StatusDown)
+	assert.False(t, vs.fallback)
+
+	// No healthy backends left, the fallback takes over.
+	update("b", pulse.StatusDown)
+	assert.True(t, vs.fallback)
+
+	// And it's withdrawn as soon as a backend recovers.
+	update("a", pulse.StatusUp)
+	assert.False(t, vs.fallback)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestFallbackBackendFollowsServiceChanges(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+	defer close(c.stopCh)
+
+	options := func(port uint16) *ServiceOptions {
+		return &ServiceOptions{Host: "10.0.0.1", Port: 80, Method: "rr",
+			Fallback: &BackendOptions{Host: "10.0.0.9", Port: port, Weight: 100, Method: "nat"}}
+	}
+
+	mockIpvs.On("AddService", "10.0.0.1", uint16(80), "tcp", uint32(0), "rr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockIpvs.On("UpdateService", "10.0.0.1", uint16(80), "tcp", uint32(0), "rr", []string(nil),
+		uint32(0), uint8(0)).Return(nil)
+	mockDisco.On("Expose", vsID, "10.0.0.1", uint16(80)).Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil)
+	mockIpvs.On("UpdateDestPort", "10.0.0.1", uint16(80), "10.0.0.2", uint16(8080), "tcp",
+		uint32(0), uint32(0), "nat").Return(nil)
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.9", uint16(8080), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil).Twice()
+	mockIpvs.On("DelDestPort", "10.0.0.1", uint16(80), "10.0.0.9", uint16(8080), "tcp",
+		uint32(0)).Return(nil).Twice()
+	mockIpvs.On("AddDestPort", "10.0.0.1", uint16(80), "10.0.0.9", uint16(8081), "tcp",
+		uint32(0), uint32(100), "nat").Return(nil).Once()
+
+	// A service without backends is served by its fallback backend right away.
+	assert.NoError(t, c.CreateService(vsID, options(8080)))
+	assert.True(t, c.services[vsID].fallback)
+
+	assert.NoError(t, c.CreateBackend(vsID, rsID, &BackendOptions{Host: "10.0.0.2", Port: 8080,
+		Weight: 100, Method: "nat", Pulse: &pulse.Options{Type: "none"}}))
+	assert.False(t, c.services[vsID].fallback)
+
+	// Draining the only backend brings the fallback backend back.
+	assert.NoError(t, c.DrainBackend(vsID, rsID, time.Minute))
+	assert.True(t, c.services[vsID].fallback)
+
+	// Unchanged fallback backends are left alone, changed ones are replaced.
+	assert.NoError(t, c.UpdateService(vsID, options(8080)))
+	assert.NoError(t, c.UpdateService(vsID, options(8081)))
+	assert.True(t, c.services[vsID].fallback)
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestFallbackBackendMustNotBeRegularBackend(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	defer close(c.stopCh)
+
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1"),
+		Fallback: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.9")}}}
+	c.services[vsID] = vs
+	c.backends[rsID] = &backend{service: vs, options: &BackendOptions{Port: 8080, host: net.ParseIP("10.0.0.2")}}
+
+	err := c.CreateBackend(vsID, "other", &BackendOptions{Host: "10.0.0.9", Port: 8080,
+		Pulse: &pulse.Options{Type: "none"}})
+	assert.Equal(t, ErrFallbackIsBackend, err)
+
+	err = c.UpdateService(vsID, &ServiceOptions{Host: "10.0.0.1", Port: 80,
+		Fallback: &BackendOptions{Host: "10.0.0.2", Port: 8080}})
+	assert.Equal(t, ErrFallbackIsBackend, err)
+	assert.Equal(t, "10.0.0.9", vs.options.Fallback.host.String())
+
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestFallbackBackendTakesOverFromPanicMode(t *testing.T) {
+	vs := &service{options: &ServiceOptions{Port: 80, Protocol: "tcp", MinHealthy: 2,
+		Fallback: &BackendOptions{Port: 8080, Weight: 100, Method: "nat", host: net.ParseIP("10.0.0.9")}}}
+	backends := map[string]*backend{
+		"a": {service: vs, weight: 100, options: &BackendOptions{Weight: 100, Port: 8080, host: net.ParseIP("10.0.0.2")}},
+		"b": {service: vs, weight: 100, options: &BackendOptions{Weight: 100, Port: 8080, host: net.ParseIP("10.0.0.3")}},
+	}
+
+	stash := make(map[pulse.ID]uint32)
+	mockIpvs := &fakeIpvs{}
+	c := newRoutineContext(backends, mockIpvs)
+	c.services[vsID] = vs
+
+	update := func(id string, status pulse.StatusType) {
+		c.processPulseUpdate(stash, pulse.Update{pulse.ID{VsID: vsID, RsID: id}, pulse.Metrics{Status: status, Health: 1}})
+	}
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, uint16(80), mock.Anything, uint16(8080), "tcp", uint32(0),
+		mock.Anything, mock.Anything).Return(nil)
+	mockIpvs.On("AddDestPort", mock.Anything, uint16(80), "10.0.0.9", uint16(8080), "tcp", uint32(0),
+		uint32(100), "nat").Return(nil).Once()
+	mockIpvs.On("DelDestPort", mock.Anything, uint16(80), "10.0.0.9", uint16(8080), "tcp", uint32(0)).
+		Return(nil).Once()
+
+	// A single healthy backend is below the minimum, so the other one keeps its weight.
+	update("a", pulse.StatusDown)
+	assert.True(t, vs.panic)
+	assert.False(t, vs.fallback)
+	assert.Equal(t, uint32(100), backends["a"].options.Weight)
+
+	// Once none are healthy, the fallback backend serves alone.
+	update("b", pulse.StatusDown)
+	assert.False(t, vs.panic)
+	assert.True(t, vs.fallback)
+	assert.Equal(t, uint32(0), backends["a"].options.Weight)
+	assert.Equal(t, uint32(0), backends["b"].options.Weight)
+
+	// A recovered backend brings panic mode back instead of the fallback backend.
+	update("b", pulse.StatusUp)
+	assert.True(t, vs.panic)
+	assert.False(t, vs.fallback)
+	assert.Equal(t, uint32(100), backends["a"].options.Weight)
+	assert.Equal(t, uint32(100), backends["b"].options.Weight)
+
+	mockIpvs.AssertExpectations(t)
+}
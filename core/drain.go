@@ -0,0 +1,129 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Possible drain errors.
+var (
+	ErrBackendDraining     = errors.New("backend is being drained")
+	ErrInvalidDrainTimeout = errors.New("drain timeout must be positive")
+)
+
+// Interval between connection count checks of draining backends.
+var drainCheckInterval = time.Second
+
+// DrainInfo describes a backend which is being drained before its removal.
+type DrainInfo struct {
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+
+	// Set if removing the drained backend failed, it's retried until it succeeds.
+	Error string `json:"error,omitempty"`
+}
+
+// DrainBackend stops scheduling new connections to the backend, and removes it once
+// it has no active connections left or the timeout expires.
+func (ctx *Context) DrainBackend(vsID, rsID string, timeout time.Duration) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if timeout <= 0 {
+		return ErrInvalidDrainTimeout
+	}
+
+	rs, exists := ctx.backends[rsID]
+	if !exists {
+		return ErrObjectNotFound
+	} else if rs.drain != nil {
+		return ErrBackendDraining
+	}
+
+	if _, err := ctx.updateBackend(vsID, rsID, 0); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rs.drain = &DrainInfo{Started: now, Deadline: now.Add(timeout)}
+
+	// Draining backends don't count as healthy.
+	ctx.refreshFallback(vsID, rs.service)
+
+	log.Infof("draining backend [%s/%s] for up to %s", vsID, rsID, timeout)
+
+	go ctx.drainBackend(vsID, rsID, rs)
+
+	return nil
+}
+
+func (ctx *Context) drainBackend(vsID, rsID string, rs *backend) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ctx.checkDrain(vsID, rsID, rs) {
+				return
+			}
+		case <-ctx.stopCh:
+			return
+		}
+	}
+}
+
+// checkDrain removes a drained backend, it returns true once draining is over.
+func (ctx *Context) checkDrain(vsID, rsID string, rs *backend) bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if ctx.backends[rsID] != rs {
+		// The backend or its service has been removed in the meantime.
+		return true
+	}
+
+	stats, err := ctx.backendStats(rs)
+	if err != nil {
+		log.Errorf("error while reading stats of draining backend [%s/%s]: %s", vsID, rsID, err)
+	}
+
+	if err == nil && stats.ActiveConns == 0 {
+		log.Infof("backend [%s/%s] has been drained", vsID, rsID)
+	} else if time.Now().After(rs.drain.Deadline) {
+		log.Warnf("backend [%s/%s] drain timed out, removing it anyway", vsID, rsID)
+	} else {
+		return false
+	}
+
+	if _, err := ctx.removeBackend(vsID, rsID); err != nil {
+		// The backend is left as it was, so its removal is retried on the next check.
+		log.Errorf("error while removing drained backend [%s/%s]: %s", vsID, rsID, err)
+		rs.drain.Error = err.Error()
+		return false
+	}
+
+	return true
+}
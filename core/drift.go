@@ -0,0 +1,384 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kobolog/gorb/ipvs-shim"
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Possible kinds of drift between the Context and IPVS.
+const (
+	DriftMissingService  = "missing-service"
+	DriftUnknownService  = "unknown-service"
+	DriftServiceMismatch = "service-mismatch"
+	DriftMissingBackend  = "missing-backend"
+	DriftUnknownBackend  = "unknown-backend"
+	DriftBackendMismatch = "backend-mismatch"
+)
+
+var driftKinds = []string{
+	DriftMissingService,
+	DriftUnknownService,
+	DriftServiceMismatch,
+	DriftMissingBackend,
+	DriftUnknownBackend,
+	DriftBackendMismatch,
+}
+
+// Drift describes a difference between the Context and IPVS, e.g. after a manual
+// ipvsadm change or a partially failed update. Unknown entries have no IDs.
+type Drift struct {
+	Kind     string `json:"kind"`
+	VsID     string `json:"vsid,omitempty"`
+	RsID     string `json:"rsid,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+
+	// Set if the drift couldn't be repaired.
+	Error string `json:"error,omitempty"`
+
+	// Entries only found in IPVS, needed to remove them.
+	service *ipvs_shim.Service
+	dest    *ipvs_shim.Destination
+}
+
+// DriftReport contains the result of a drift check. Repaired is only set if all
+// drifts have been repaired.
+type DriftReport struct {
+	Checked  time.Time `json:"checked"`
+	Drifts   []Drift   `json:"drifts"`
+	Repaired bool      `json:"repaired"`
+}
+
+func serviceEndpoint(opts *ServiceOptions) string {
+	if opts.FwMark != 0 {
+		return fmt.Sprintf("fwmark:%d/%s", opts.FwMark, familyName(util.AddrFamily(opts.host)))
+	}
+	return net.JoinHostPort(opts.host.String(), strconv.Itoa(int(opts.Port))) + "/" + opts.Protocol
+}
+
+func familyName(family int) string {
+	if family == util.IPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func splitFlags(flags string) []string {
+	if len(flags) == 0 {
+		return nil
+	}
+	return strings.Split(flags, "|")
+}
+
+// expectedNetmask is the persistence netmask as reported by IPVS.
+func expectedNetmask(opts *ServiceOptions) uint8 {
+	if opts.timeout == 0 {
+		return 0
+	} else if opts.PersistenceNetmask != 0 {
+		return opts.PersistenceNetmask
+	} else if util.AddrFamily(opts.host) == util.IPv4 {
+		return 8 * net.IPv4len
+	}
+	return 8 * net.IPv6len
+}
+
+func describeService(method string, flags []string, timeout uint32, netmask uint8) string {
+	return fmt.Sprintf("method=%s flags=%s timeout=%d netmask=%d",
+		method, strings.Join(flags, "|"), timeout, netmask)
+}
+
+func describeBackend(weight uint32, method string) string {
+	return fmt.Sprintf("weight=%d method=%s", weight, method)
+}
+
+// findService looks up the IPVS entry for a virtual service.
+func findService(svcs []*ipvs_shim.Service, opts *ServiceOptions) *ipvs_shim.Service {
+	for _, svc := range svcs {
+		if opts.FwMark != 0 {
+			if svc.FwMark == opts.FwMark && svc.Family == util.AddrFamily(opts.host) {
+				return svc
+			}
+		} else if svc.FwMark == 0 && opts.host.Equal(net.ParseIP(svc.VIP)) &&
+			svc.Port == opts.Port && svc.Protocol == opts.Protocol {
+			return svc
+		}
+	}
+	return nil
+}
+
+// detectDrift compares the Context with IPVS, the caller must hold the mutex.
+func (ctx *Context) detectDrift() ([]Drift, error) {
+	svcs, err := ctx.ipvs.ListServices()
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := []Drift{}
+	known := make(map[*ipvs_shim.Service]bool)
+
+	for vsID, vs := range ctx.services {
+		opts := vs.options
+		svc := findService(svcs, opts)
+
+		if svc == nil {
+			drifts = append(drifts, Drift{
+				Kind:     DriftMissingService,
+				VsID:     vsID,
+				Endpoint: serviceEndpoint(opts)})
+			continue
+		}
+
+		known[svc] = true
+
+		if svc.Sched != opts.Method || !ipvs_shim.SameFlags(svc.Flags, splitFlags(opts.Flags)) ||
+			svc.Timeout != opts.timeout || svc.Netmask != expectedNetmask(opts) {
+			drifts = append(drifts, Drift{
+				Kind:     DriftServiceMismatch,
+				VsID:     vsID,
+				Endpoint: serviceEndpoint(opts),
+				Expected: describeService(opts.Method, splitFlags(opts.Flags), opts.timeout, expectedNetmask(opts)),
+				Actual:   describeService(svc.Sched, svc.Flags, svc.Timeout, svc.Netmask)})
+		}
+
+		dests, err := ctx.listDestinations(vs)
+		if err != nil {
+			return nil, err
+		}
+
+		drifts = append(drifts, ctx.detectBackendDrift(vsID, vs, dests)...)
+	}
+
+	for _, svc := range svcs {
+		if known[svc] {
+			continue
+		}
+
+		_, opts := adoptedServiceOptions(svc)
+		drifts = append(drifts, Drift{
+			Kind:     DriftUnknownService,
+			Endpoint: serviceEndpoint(opts),
+			Actual:   describeService(svc.Sched, svc.Flags, svc.Timeout, svc.Netmask),
+			service:  svc})
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].VsID != drifts[j].VsID {
+			return drifts[i].VsID < drifts[j].VsID
+		} else if drifts[i].RsID != drifts[j].RsID {
+			return drifts[i].RsID < drifts[j].RsID
+		}
+		return drifts[i].Endpoint < drifts[j].Endpoint
+	})
+
+	return drifts, nil
+}
+
+func (ctx *Context) detectBackendDrift(vsID string, vs *service, dests []*ipvs_shim.Destination) []Drift {
+	var drifts []Drift
+	known := make(map[*ipvs_shim.Destination]bool)
+
+	for rsID, rs := range ctx.backends {
+		if rs.service != vs {
+			continue
+		}
+
+		opts := rs.options
+		endpoint := net.JoinHostPort(opts.host.String(), strconv.Itoa(int(opts.Port)))
+
+		dest := findDestination(dests, opts)
+		if dest == nil {
+			drifts = append(drifts, Drift{
+				Kind:     DriftMissingBackend,
+				VsID:     vsID,
+				RsID:     rsID,
+				Endpoint: endpoint})
+			continue
+		}
+
+		known[dest] = true
+
+		if weight := rs.ipvsWeight(); dest.Weight != weight || !ipvs_shim.SameForwarding(dest.Fwd, opts.Method) {
+			drifts = append(drifts, Drift{
+				Kind:     DriftBackendMismatch,
+				VsID:     vsID,
+				RsID:     rsID,
+				Endpoint: endpoint,
+				Expected: describeBackend(weight, opts.Method),
+				Actual:   describeBackend(dest.Weight, dest.Fwd)})
+		}
+	}
+
+	if vs.fallback {
+		if dest := findDestination(dests, vs.options.Fallback); dest != nil {
+			known[dest] = true
+		}
+	}
+
+	for _, dest := range dests {
+		if known[dest] {
+			continue
+		}
+
+		drifts = append(drifts, Drift{
+			Kind:     DriftUnknownBackend,
+			VsID:     vsID,
+			Endpoint: net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))),
+			Actual:   describeBackend(dest.Weight, dest.Fwd),
+			dest:     dest})
+	}
+
+	return drifts
+}
+
+// repairDrift reverts IPVS to the Context state, the caller must hold the mutex.
+// Drifts which couldn't be repaired get their Error set, and false is returned.
+func (ctx *Context) repairDrift(drifts []Drift) bool {
+	repaired := true
+
+	for i, d := range drifts {
+		log.Infof("repairing %s %s", d.Kind, d.Endpoint)
+
+		if err := ctx.repair(d); err != nil {
+			log.Errorf("error while repairing %s %s: %s", d.Kind, d.Endpoint, err)
+			drifts[i].Error, repaired = err.Error(), false
+		}
+	}
+
+	return repaired
+}
+
+func (ctx *Context) repair(d Drift) error {
+	switch d.Kind {
+	case DriftMissingService:
+		vs := ctx.services[d.VsID].options
+		if err := ctx.ipvs.AddService(vs.host.String(), vs.Port, vs.Protocol, vs.FwMark, vs.Method,
+			splitFlags(vs.Flags), vs.timeout, vs.PersistenceNetmask); err != nil {
+			return err
+		}
+
+		// Backends of a missing service are gone as well.
+		for _, rs := range ctx.backends {
+			if rs.service != ctx.services[d.VsID] {
+				continue
+			}
+			if err := ctx.ipvs.AddDestPort(vs.host.String(), vs.Port, rs.options.host.String(),
+				rs.options.Port, vs.Protocol, vs.FwMark, rs.ipvsWeight(), rs.options.Method); err != nil {
+				return err
+			}
+		}
+
+		if fb := vs.Fallback; ctx.services[d.VsID].fallback {
+			return ctx.ipvs.AddDestPort(vs.host.String(), vs.Port, fb.host.String(), fb.Port,
+				vs.Protocol, vs.FwMark, fb.Weight, fb.Method)
+		}
+
+	case DriftServiceMismatch:
+		vs := ctx.services[d.VsID].options
+		return ctx.ipvs.UpdateService(vs.host.String(), vs.Port, vs.Protocol, vs.FwMark, vs.Method,
+			splitFlags(vs.Flags), vs.timeout, vs.PersistenceNetmask)
+
+	case DriftUnknownService:
+		_, vs := adoptedServiceOptions(d.service)
+		return ctx.ipvs.DelService(vs.host.String(), vs.Port, vs.Protocol, vs.FwMark)
+
+	case DriftMissingBackend, DriftBackendMismatch:
+		vs, rs := ctx.services[d.VsID].options, ctx.backends[d.RsID]
+		if d.Kind == DriftMissingBackend {
+			return ctx.ipvs.AddDestPort(vs.host.String(), vs.Port, rs.options.host.String(), rs.options.Port,
+				vs.Protocol, vs.FwMark, rs.ipvsWeight(), rs.options.Method)
+		}
+		return ctx.ipvs.UpdateDestPort(vs.host.String(), vs.Port, rs.options.host.String(), rs.options.Port,
+			vs.Protocol, vs.FwMark, rs.ipvsWeight(), rs.options.Method)
+
+	case DriftUnknownBackend:
+		vs := ctx.services[d.VsID].options
+		return ctx.ipvs.DelDestPort(vs.host.String(), vs.Port, d.dest.Host, d.dest.Port,
+			vs.Protocol, vs.FwMark)
+	}
+
+	return nil
+}
+
+// checkDrift compares the Context with IPVS, optionally repairing any drift.
+func (ctx *Context) checkDrift(repair bool) (*DriftReport, error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	drifts, err := ctx.detectDrift()
+	if err != nil {
+		log.Errorf("error while checking IPVS for drift: %s", err)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	report := &DriftReport{Checked: time.Now(), Drifts: drifts}
+
+	if len(drifts) > 0 {
+		log.Warnf("found %d difference(s) between the context and IPVS", len(drifts))
+
+		if repair {
+			report.Repaired = ctx.repairDrift(drifts)
+		}
+	}
+
+	ctx.drift = report
+
+	return report, nil
+}
+
+// lastDrift returns the result of the last drift check, if any.
+func (ctx *Context) lastDrift() *DriftReport {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	return ctx.drift
+}
+
+// Drift checks IPVS for differences from the Context, without repairing them.
+func (ctx *Context) Drift() (*DriftReport, error) {
+	return ctx.checkDrift(false)
+}
+
+// reconcile periodically checks IPVS for drift until the Context is closed.
+func (ctx *Context) reconcile(interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx.checkDrift(repair)
+		case <-ctx.stopCh:
+			log.Debug("drift reconciler has been stopped")
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kobolog/gorb/util"
+)
+
+// Comma separated ports or port ranges, as accepted by the iptables multiport match.
+var reFwMarkPorts = regexp.MustCompile(`^[0-9]+(:[0-9]+)?(,[0-9]+(:[0-9]+)?)*$`)
+
+// iptables runs the iptables binary for the given address family. It's a variable
+// so that tests can intercept rule changes.
+var iptables = func(family int, args ...string) error {
+	name := "iptables"
+	if family == util.IPv6 {
+		name = "ip6tables"
+	}
+
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %s (%s)", name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// fwMarkRule returns the mangle table rule marking traffic for a service.
+func fwMarkRule(vsID string, opts *ServiceOptions) []string {
+	return []string{
+		"PREROUTING",
+		"-d", opts.host.String(),
+		"-p", opts.Protocol,
+		"-m", "multiport", "--dports", opts.FwMarkPorts,
+		"-m", "comment", "--comment", "gorb:" + vsID,
+		"-j", "MARK", "--set-mark", strconv.FormatUint(uint64(opts.FwMark), 10),
+	}
+}
+
+func addFwMarkRule(vsID string, opts *ServiceOptions) error {
+	args := append([]string{"-w", "-t", "mangle", "-A"}, fwMarkRule(vsID, opts)...)
+	return iptables(util.AddrFamily(opts.host), args...)
+}
+
+func delFwMarkRule(vsID string, opts *ServiceOptions) error {
+	args := append([]string{"-w", "-t", "mangle", "-D"}, fwMarkRule(vsID, opts)...)
+	return iptables(util.AddrFamily(opts.host), args...)
+}
+
+// ensureFwMarkRule adds the mark rule for a service unless it's already installed.
+func ensureFwMarkRule(vsID string, opts *ServiceOptions) error {
+	args := append([]string{"-w", "-t", "mangle", "-C"}, fwMarkRule(vsID, opts)...)
+	if iptables(util.AddrFamily(opts.host), args...) == nil {
+		return nil
+	}
+	return addFwMarkRule(vsID, opts)
+}
@@ -24,9 +24,11 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/kobolog/gorb/ipvs-shim"
 	"github.com/kobolog/gorb/pulse"
+	"github.com/kobolog/gorb/util"
 )
 
 // Possible validation errors.
@@ -35,8 +37,27 @@ var (
 	ErrUnknownMethod   = errors.New("specified forwarding method is unknown")
 	ErrUnknownProtocol = errors.New("specified protocol is unknown")
 	ErrUnknownFlag     = errors.New("specified flag is unknown")
+
+	ErrInvalidPersistenceTimeout = errors.New("persistence timeout must be at least 1 second")
+	ErrInvalidPersistenceNetmask = errors.New("persistence netmask is too long for the address family")
+	ErrMissingFwMark             = errors.New("firewall mark ports require a firewall mark")
+	ErrInvalidFwMarkPorts        = errors.New("firewall mark ports must be a list of ports or port ranges")
+	ErrUnknownRecovery           = errors.New("specified recovery policy is unknown")
+	ErrInvalidRecoveryPeriod     = errors.New("recovery period must be positive")
+	ErrInvalidMinHealthy         = errors.New("minimum number of healthy backends can't be negative")
+)
+
+// Recovery policies for backends which come back up.
+const (
+	RecoveryHealth      = "health"
+	RecoveryImmediate   = "immediate"
+	RecoveryLinear      = "linear"
+	RecoveryExponential = "exponential"
 )
 
+// Persistence timeout of persistent services if not set, same as the ipvsadm default.
+const defaultPersistenceTimeout = "300s"
+
 // ContextOptions configure Context behavior.
 type ContextOptions struct {
 	Disco        string
@@ -44,6 +65,14 @@ type ContextOptions struct {
 	Flush        bool
 	ListenPort   uint16
 	VipInterface string
+	Adopt        bool
+
+	// Drift between the Context and IPVS is checked every DriftInterval if it's set,
+	// and reverted if DriftRepair is set.
+	DriftInterval time.Duration
+	DriftRepair   bool
+
+	Passive PassiveOptions
 }
 
 // ServiceOptions describe a virtual service.
@@ -55,9 +84,44 @@ type ServiceOptions struct {
 	Flags      string `json:"flags"`
 	Persistent bool   `json:"persistent"`
 
+	// Persistence options, only used if Persistent is set. Netmask is a prefix length
+	// used to group clients, a single client address is used if it's not set.
+	PersistenceTimeout string `json:"persistence_timeout"`
+	PersistenceNetmask uint8  `json:"persistence_netmask"`
+
+	// Firewall mark services schedule all traffic marked with FwMark together, Port is
+	// then only used for health checks and discovery. If FwMarkPorts (e.g. "80,443" or
+	// "8000:8100") is set, the matching mark rule for Host is installed locally.
+	FwMark      uint32 `json:"fwmark"`
+	FwMarkPorts string `json:"fwmark_ports"`
+
+	// Backends which come back up regain their weight in proportion to their health
+	// check history by default, or immediately, or with a linear or exponential ramp
+	// over RecoveryPeriod.
+	Recovery       string `json:"recovery"`
+	RecoveryPeriod string `json:"recovery_period"`
+
+	// Backend weights are scaled inversely with their health check latency if set.
+	LatencyWeighting bool `json:"latency_weighting"`
+
+	// If fewer than MinHealthy backends are healthy, unhealthy ones aren't taken
+	// out of rotation either, so that the service doesn't drop all traffic.
+	MinHealthy int `json:"min_healthy"`
+
+	// Fallback backend, e.g. a maintenance page server, which is only added while
+	// none of the other backends are healthy. Its pulse is ignored. It takes over
+	// from panic mode, so unhealthy backends are taken out of rotation meanwhile.
+	Fallback *BackendOptions `json:"fallback"`
+
 	// Host string resolved to an IP, including DNS lookup.
-	host      net.IP
-	delIfAddr bool
+	host          net.IP
+	delIfAddr     bool
+	delFwMarkRule bool
+
+	// Persistence timeout in seconds, zero if the service is not persistent.
+	timeout uint32
+
+	recoveryPeriod time.Duration
 }
 
 // Fill missing fields and validates virtual service configuration.
@@ -87,6 +151,14 @@ func (o *ServiceOptions) Fill(defaultHost net.IP) error {
 		return ErrUnknownProtocol
 	}
 
+	if len(o.FwMarkPorts) != 0 {
+		if o.FwMark == 0 {
+			return ErrMissingFwMark
+		} else if !reFwMarkPorts.MatchString(o.FwMarkPorts) {
+			return ErrInvalidFwMarkPorts
+		}
+	}
+
 	if o.Flags != "" {
 		for _, flag := range strings.Split(o.Flags, "|") {
 			if ok := ipvs_shim.ValidFlag(flag); !ok {
@@ -100,6 +172,72 @@ func (o *ServiceOptions) Fill(defaultHost net.IP) error {
 		o.Method = "wrr"
 	}
 
+	if len(o.Recovery) == 0 {
+		o.Recovery = RecoveryHealth
+	}
+
+	o.Recovery = strings.ToLower(o.Recovery)
+	o.recoveryPeriod = 0
+
+	switch o.Recovery {
+	case RecoveryHealth, RecoveryImmediate:
+	case RecoveryLinear, RecoveryExponential:
+		if len(o.RecoveryPeriod) == 0 {
+			o.RecoveryPeriod = "1m"
+		}
+
+		period, err := util.ParseInterval(o.RecoveryPeriod)
+		if err != nil {
+			return err
+		} else if period <= 0 {
+			return ErrInvalidRecoveryPeriod
+		}
+
+		o.recoveryPeriod = period
+	default:
+		return ErrUnknownRecovery
+	}
+
+	if o.MinHealthy < 0 {
+		return ErrInvalidMinHealthy
+	}
+
+	if o.Fallback != nil {
+		if err := o.Fallback.Fill(); err != nil {
+			return err
+		} else if o.Fallback.Port == 0 && o.FwMark == 0 {
+			return ErrMissingEndpoint
+		} else if util.AddrFamily(o.Fallback.host) != util.AddrFamily(o.host) {
+			return ErrIncompatibleAFs
+		}
+	}
+
+	o.timeout = 0
+
+	if o.Persistent {
+		if len(o.PersistenceTimeout) == 0 {
+			o.PersistenceTimeout = defaultPersistenceTimeout
+		}
+
+		timeout, err := util.ParseInterval(o.PersistenceTimeout)
+		if err != nil {
+			return err
+		} else if timeout < time.Second {
+			return ErrInvalidPersistenceTimeout
+		}
+
+		o.timeout = uint32(timeout / time.Second)
+
+		maxPrefix := 8 * net.IPv6len
+		if util.AddrFamily(o.host) == util.IPv4 {
+			maxPrefix = 8 * net.IPv4len
+		}
+
+		if int(o.PersistenceNetmask) > maxPrefix {
+			return ErrInvalidPersistenceNetmask
+		}
+	}
+
 	return nil
 }
 
@@ -122,6 +260,40 @@ func (o *ServiceOptions) CompareStoreOptions(options *ServiceOptions) bool {
 	if o.Persistent != options.Persistent {
 		return false
 	}
+	// Persistent services stored before the timeout was filled in use the default one.
+	if o.PersistenceTimeout != options.PersistenceTimeout && !(o.Persistent &&
+		o.PersistenceTimeout == defaultPersistenceTimeout && len(options.PersistenceTimeout) == 0) {
+		return false
+	}
+	if o.PersistenceNetmask != options.PersistenceNetmask {
+		return false
+	}
+	if o.FwMark != options.FwMark {
+		return false
+	}
+	if o.FwMarkPorts != options.FwMarkPorts {
+		return false
+	}
+	// Services stored before recovery policies were added use the default one.
+	if o.Recovery != options.Recovery && !(o.Recovery == RecoveryHealth && len(options.Recovery) == 0) {
+		return false
+	}
+	if o.RecoveryPeriod != options.RecoveryPeriod {
+		return false
+	}
+	if o.LatencyWeighting != options.LatencyWeighting {
+		return false
+	}
+	if o.MinHealthy != options.MinHealthy {
+		return false
+	}
+	if (o.Fallback == nil) != (options.Fallback == nil) {
+		return false
+	}
+	if o.Fallback != nil && (!o.Fallback.CompareStoreOptions(options.Fallback) ||
+		o.Fallback.Weight != options.Fallback.Weight) {
+		return false
+	}
 	return true
 }
 
@@ -138,9 +310,10 @@ type BackendOptions struct {
 	host net.IP
 }
 
-// Fill missing fields and validates backend configuration.
+// Fill missing fields and validates backend configuration. Port is validated when
+// the backend is attached, as firewall mark services allow it to be omitted.
 func (o *BackendOptions) Fill() error {
-	if len(o.Host) == 0 || o.Port == 0 {
+	if len(o.Host) == 0 {
 		return ErrMissingEndpoint
 	}
 
@@ -171,6 +344,24 @@ func (o *BackendOptions) Fill() error {
 	return nil
 }
 
+// Copy returns a deep copy of the backend options.
+func (o *BackendOptions) Copy() *BackendOptions {
+	result := *o
+
+	if o.Pulse != nil {
+		p := *o.Pulse
+		if o.Pulse.Args != nil {
+			p.Args = make(util.DynamicMap, len(o.Pulse.Args))
+			for k, v := range o.Pulse.Args {
+				p.Args[k] = v
+			}
+		}
+		result.Pulse = &p
+	}
+
+	return &result
+}
+
 func (o *BackendOptions) CompareStoreOptions(options *BackendOptions) bool {
 	if o.Host != options.Host {
 		return false
@@ -2,6 +2,7 @@ package core
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,3 +27,118 @@ func TestValidateAcceptsNoFlags(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestFillSetsPersistenceDefaults(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", Persistent: true}
+	err := options.Fill(nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "300s", options.PersistenceTimeout)
+	assert.Equal(t, uint32(300), options.timeout)
+}
+
+func TestCompareStoreOptionsFillsLegacyDefaults(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", Persistent: true}
+	assert.NoError(t, options.Fill(nil))
+
+	stored := ServiceOptions{Port: 80, Host: "10.0.0.1", Protocol: "tcp", Method: "wrr", Persistent: true}
+	assert.True(t, options.CompareStoreOptions(&stored))
+
+	stored.PersistenceTimeout = "60s"
+	assert.False(t, options.CompareStoreOptions(&stored))
+}
+
+func TestFillIgnoresPersistenceOptionsIfNotPersistent(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", PersistenceTimeout: "10m"}
+	err := options.Fill(nil)
+
+	assert.NoError(t, err)
+	assert.Zero(t, options.timeout)
+}
+
+func TestFillRejectsInvalidPersistenceOptions(t *testing.T) {
+	tests := []struct {
+		options ServiceOptions
+		err     error
+	}{
+		{
+			ServiceOptions{Port: 80, Host: "10.0.0.1", Persistent: true, PersistenceTimeout: "0s"},
+			ErrInvalidPersistenceTimeout,
+		},
+		{
+			ServiceOptions{Port: 80, Host: "10.0.0.1", Persistent: true, PersistenceNetmask: 33},
+			ErrInvalidPersistenceNetmask,
+		},
+		{
+			ServiceOptions{Port: 80, Host: "fd11:bcb5:61df::1", Persistent: true, PersistenceNetmask: 129},
+			ErrInvalidPersistenceNetmask,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.err, test.options.Fill(nil))
+	}
+}
+
+func TestValidateFwMarkPorts(t *testing.T) {
+	tests := []struct {
+		options ServiceOptions
+		err     error
+	}{
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", FwMark: 1, FwMarkPorts: "80,443,8000:8100"}, nil},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", FwMarkPorts: "80,443"}, ErrMissingFwMark},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", FwMark: 1, FwMarkPorts: "80;443"}, ErrInvalidFwMarkPorts},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.err, test.options.Fill(nil))
+	}
+}
+
+func TestValidateAcceptsSCTP(t *testing.T) {
+	options := ServiceOptions{Port: 2905, Host: "localhost", Protocol: "SCTP"}
+	err := options.Fill(nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sctp", options.Protocol)
+}
+
+func TestValidateRecoveryOptions(t *testing.T) {
+	tests := []struct {
+		options ServiceOptions
+		err     error
+		period  time.Duration
+	}{
+		{ServiceOptions{Port: 80, Host: "10.0.0.1"}, nil, 0},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", Recovery: "Immediate"}, nil, 0},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", Recovery: "linear"}, nil, time.Minute},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", Recovery: "exponential", RecoveryPeriod: "5m"}, nil, 5 * time.Minute},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", Recovery: "linear", RecoveryPeriod: "0s"}, ErrInvalidRecoveryPeriod, 0},
+		{ServiceOptions{Port: 80, Host: "10.0.0.1", Recovery: "instant"}, ErrUnknownRecovery, 0},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.err, test.options.Fill(nil))
+		assert.Equal(t, test.period, test.options.recoveryPeriod)
+	}
+}
+
+func TestValidateMinHealthy(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", MinHealthy: -1}
+	assert.Equal(t, ErrInvalidMinHealthy, options.Fill(nil))
+
+	options = ServiceOptions{Port: 80, Host: "10.0.0.1", MinHealthy: 2}
+	assert.NoError(t, options.Fill(nil))
+}
+
+func TestValidateFallback(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", Fallback: &BackendOptions{Host: "10.0.0.9"}}
+	assert.Equal(t, ErrMissingEndpoint, options.Fill(nil))
+
+	options = ServiceOptions{Port: 80, Host: "10.0.0.1", Fallback: &BackendOptions{Host: "fd11:bcb5:61df::9", Port: 8080}}
+	assert.Equal(t, ErrIncompatibleAFs, options.Fill(nil))
+
+	options = ServiceOptions{Port: 80, Host: "10.0.0.1", Fallback: &BackendOptions{Host: "10.0.0.9", Port: 8080}}
+	assert.NoError(t, options.Fill(nil))
+	assert.Equal(t, uint32(100), options.Fallback.Weight)
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kobolog/gorb/ipvs-shim"
+	"github.com/kobolog/gorb/pulse"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PassiveOptions configure passive health checking, which ejects backends based on
+// their IPVS statistics sampled every Interval. It's disabled if Interval isn't set.
+type PassiveOptions struct {
+	Interval time.Duration
+
+	// A TCP backend is ejected if at least MinConns of its connections are inactive,
+	// and they make up more than InactiveRatio of all of them. Disabled if not set.
+	InactiveRatio float64
+
+	// A NAT backend is also ejected if it got at least MinConns new connections
+	// since the last sample, but sent nothing while other backends of the service did.
+	MinConns uint32
+
+	// Backends are kept down for Ejection, then their pulse decides again.
+	Ejection time.Duration
+}
+
+// EjectionInfo describes a backend which has been ejected by passive health checking.
+type EjectionInfo struct {
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// passiveSample is the change of backend statistics since the previous sample.
+type passiveSample struct {
+	rsID     string
+	rs       *backend
+	dest     *ipvs_shim.Destination
+	conns    uint32
+	bytesOut uint64
+}
+
+func (ctx *Context) watchPassive(opts PassiveOptions) {
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Ejections are processed by the Context like any pulse update.
+			for _, u := range ctx.checkPassive(opts) {
+				select {
+				case ctx.pulseCh <- u:
+				case <-ctx.stopCh:
+					return
+				}
+			}
+		case <-ctx.stopCh:
+			log.Debug("passive health checker has been stopped")
+			return
+		}
+	}
+}
+
+// checkPassive samples IPVS statistics of all backends, and returns down updates
+// for the ones which have been ejected.
+func (ctx *Context) checkPassive(opts PassiveOptions) []pulse.Update {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	now := time.Now()
+
+	for rsID, rs := range ctx.backends {
+		if rs.ejection != nil && now.After(rs.ejection.Until) {
+			log.Infof("passive ejection of backend [%s] has expired", rsID)
+			rs.ejection = nil
+		}
+	}
+
+	// Read all destinations at once, as listing them per service dumps the
+	// whole service table every time.
+	svcs, err := ctx.ipvs.ListServicesWithDestinations()
+	if err != nil {
+		log.Errorf("error while reading IPVS stats: %s", err)
+		return nil
+	}
+
+	var updates []pulse.Update
+
+	for vsID, vs := range ctx.services {
+		svc := findService(svcs, vs.options)
+		if svc == nil {
+			log.Errorf("error while reading stats of service [%s]: %s", vsID, ErrObjectNotFound)
+			continue
+		}
+		dests := svc.Destinations
+
+		var (
+			samples []passiveSample
+			traffic bool
+		)
+
+		for rsID, rs := range ctx.backends {
+			if rs.service != vs {
+				continue
+			}
+
+			dest := findDestination(dests, rs.options)
+			prev := rs.sample
+			rs.sample = dest
+
+			if dest == nil || prev == nil {
+				continue
+			}
+
+			// Counters wrap around, so do the differences.
+			s := passiveSample{
+				rsID:     rsID,
+				rs:       rs,
+				dest:     dest,
+				conns:    dest.Stats.Connections - prev.Stats.Connections,
+				bytesOut: dest.Stats.BytesOut - prev.Stats.BytesOut,
+			}
+
+			// Only NAT backends reply through IPVS.
+			if rs.options.Method == "nat" && s.bytesOut > 0 {
+				traffic = true
+			}
+
+			samples = append(samples, s)
+		}
+
+		for _, s := range samples {
+			if s.rs.ejection != nil || s.rs.drain != nil || s.dest.Weight == 0 {
+				continue
+			}
+
+			reason := opts.failure(vs, s, traffic)
+			if len(reason) == 0 {
+				continue
+			}
+
+			log.Warnf("backend [%s/%s] has been ejected: %s", vsID, s.rsID, reason)
+
+			s.rs.ejection = &EjectionInfo{Reason: reason, Until: now.Add(opts.Ejection)}
+
+			metrics := s.rs.metrics
+			metrics.Status = pulse.StatusDown
+
+			updates = append(updates, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: s.rsID}, Metrics: metrics})
+		}
+	}
+
+	return updates
+}
+
+// failure returns the reason to eject a backend, if any.
+func (o PassiveOptions) failure(vs *service, s passiveSample, traffic bool) string {
+	// UDP and SCTP connections are always counted as inactive.
+	if total := s.dest.ActiveConns + s.dest.InactiveConns; o.InactiveRatio > 0 &&
+		vs.options.Protocol == "tcp" &&
+		s.dest.InactiveConns >= o.MinConns &&
+		float64(s.dest.InactiveConns) > o.InactiveRatio*float64(total) {
+		return fmt.Sprintf("%d of %d connections are inactive", s.dest.InactiveConns, total)
+	}
+
+	if s.rs.options.Method == "nat" && traffic && s.conns > 0 && s.conns >= o.MinConns && s.bytesOut == 0 {
+		return fmt.Sprintf("no traffic sent for %d new connections", s.conns)
+	}
+
+	return ""
+}
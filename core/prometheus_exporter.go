@@ -2,9 +2,9 @@ package core
 
 import (
 	"fmt"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -19,6 +19,18 @@ var (
 		Help:      "Health of the load balancer service",
 	}, []string{"name", "host", "port", "protocol"})
 
+	servicePanic = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_panic",
+		Help:      "Whether fewer backends of the load balancer service are healthy than required",
+	}, []string{"name", "host", "port", "protocol"})
+
+	serviceFallback = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_fallback_active",
+		Help:      "Whether the fallback backend of the load balancer service is serving traffic",
+	}, []string{"name", "host", "port", "protocol"})
+
 	serviceBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "service_backends",
@@ -34,9 +46,39 @@ var (
 	serviceBackendHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "service_backend_health",
-		Help:      "Health of a backend service",
+		Help:      "Health of a backend service over the last 5 minutes",
 	}, []string{"service_name", "name", "host", "port"})
 
+	serviceBackendHealth1h = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_health_1h",
+		Help:      "Health of a backend service over the last hour",
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendLastTransition = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_last_transition_timestamp_seconds",
+		Help:      "Time of the last status change of a backend service",
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendConsecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_consecutive_failures",
+		Help:      "Number of consecutive failed health checks of a backend service",
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_check_latency_seconds",
+		Help:      "Duration of the last health check of a backend service",
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendLatencyQuantile = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_check_latency_quantile_seconds",
+		Help:      "Latency percentiles of the last successful health checks of a backend service",
+	}, []string{"service_name", "name", "host", "port", "quantile"})
+
 	serviceBackendStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "service_backend_status",
@@ -46,10 +88,93 @@ var (
 	serviceBackendWeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "service_backend_weight",
-		Help:      "Weight of a backend service",
+		Help:      "Weight of a backend service in IPVS, including latency scaling",
 	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendDraining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_draining",
+		Help:      "Whether a backend service is being drained before its removal",
+	}, []string{"service_name", "name", "host", "port"})
+
+	serviceBackendEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_backend_ejected",
+		Help:      "Whether a backend service has been ejected by passive health checking",
+	}, []string{"service_name", "name", "host", "port"})
+
+	driftEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drift_entries",
+		Help:      "Number of differences between GORB and IPVS found by the last drift check",
+	}, []string{"kind"})
+
+	serviceStats = newStatsMetrics("service", "the load balancer service",
+		[]string{"name", "host", "port", "protocol"})
+	serviceBackendStats = newStatsMetrics("service_backend", "a backend service",
+		[]string{"service_name", "name", "host", "port"})
 )
 
+// statsMetrics export IPVS statistics of either services or backends. They're read
+// from IPVS on every scrape, so cumulative counters are exported as such.
+type statsMetrics struct {
+	activeConns   *prometheus.Desc
+	inactiveConns *prometheus.Desc
+	connections   *prometheus.Desc
+	packets       *prometheus.Desc
+	bytes         *prometheus.Desc
+	connRate      *prometheus.Desc
+	packetRate    *prometheus.Desc
+	byteRate      *prometheus.Desc
+}
+
+func newStatsMetrics(prefix, subject string, labels []string) *statsMetrics {
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", prefix+"_"+name),
+			fmt.Sprintf(help, subject), append(append([]string{}, labels...), extra...), nil)
+	}
+
+	return &statsMetrics{
+		activeConns:   desc("active_connections", "Number of active connections of %s"),
+		inactiveConns: desc("inactive_connections", "Number of inactive connections of %s"),
+		connections:   desc("connections_total", "Number of connections scheduled to %s"),
+		packets:       desc("packets_total", "Number of packets forwarded by %s", "direction"),
+		bytes:         desc("bytes_total", "Number of bytes forwarded by %s", "direction"),
+		connRate:      desc("connections_per_second", "Rate of connections scheduled to %s"),
+		packetRate:    desc("packets_per_second", "Rate of packets forwarded by %s", "direction"),
+		byteRate:      desc("bytes_per_second", "Rate of bytes forwarded by %s", "direction"),
+	}
+}
+
+func (m *statsMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{m.activeConns, m.inactiveConns, m.connections, m.packets, m.bytes,
+		m.connRate, m.packetRate, m.byteRate} {
+		ch <- d
+	}
+}
+
+func (m *statsMetrics) collect(ch chan<- prometheus.Metric, stats *Stats, labels ...string) {
+	in := append(append([]string{}, labels...), "in")
+	out := append(append([]string{}, labels...), "out")
+
+	metric := func(desc *prometheus.Desc, kind prometheus.ValueType, value float64, labels []string) {
+		ch <- prometheus.MustNewConstMetric(desc, kind, value, labels...)
+	}
+
+	metric(m.activeConns, prometheus.GaugeValue, float64(stats.ActiveConns), labels)
+	metric(m.inactiveConns, prometheus.GaugeValue, float64(stats.InactiveConns), labels)
+	metric(m.connections, prometheus.CounterValue, float64(stats.Connections), labels)
+	metric(m.packets, prometheus.CounterValue, float64(stats.PacketsIn), in)
+	metric(m.packets, prometheus.CounterValue, float64(stats.PacketsOut), out)
+	metric(m.bytes, prometheus.CounterValue, float64(stats.BytesIn), in)
+	metric(m.bytes, prometheus.CounterValue, float64(stats.BytesOut), out)
+	metric(m.connRate, prometheus.GaugeValue, float64(stats.CPS), labels)
+	metric(m.packetRate, prometheus.GaugeValue, float64(stats.PPSIn), in)
+	metric(m.packetRate, prometheus.GaugeValue, float64(stats.PPSOut), out)
+	metric(m.byteRate, prometheus.GaugeValue, float64(stats.BPSIn), in)
+	metric(m.byteRate, prometheus.GaugeValue, float64(stats.BPSOut), out)
+}
+
 type Exporter struct {
 	ctx *Context
 }
@@ -62,70 +187,159 @@ func NewExporter(ctx *Context) *Exporter {
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	serviceHealth.Describe(ch)
+	servicePanic.Describe(ch)
+	serviceFallback.Describe(ch)
 	serviceBackends.Describe(ch)
 	serviceBackendUptimeTotal.Describe(ch)
 	serviceBackendHealth.Describe(ch)
+	serviceBackendHealth1h.Describe(ch)
+	serviceBackendLastTransition.Describe(ch)
+	serviceBackendConsecutiveFailures.Describe(ch)
+	serviceBackendLatency.Describe(ch)
+	serviceBackendLatencyQuantile.Describe(ch)
 	serviceBackendStatus.Describe(ch)
 	serviceBackendWeight.Describe(ch)
+	serviceBackendDraining.Describe(ch)
+	serviceBackendEjected.Describe(ch)
+	driftEntries.Describe(ch)
+	serviceStats.Describe(ch)
+	serviceBackendStats.Describe(ch)
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	if err := e.collect(); err != nil {
-		log.Errorf("error collecting metrics: %s", err)
-		return
-	}
+	e.collect(ch)
 	serviceHealth.Collect(ch)
+	servicePanic.Collect(ch)
+	serviceFallback.Collect(ch)
 	serviceBackends.Collect(ch)
 	serviceBackendUptimeTotal.Collect(ch)
 	serviceBackendHealth.Collect(ch)
+	serviceBackendHealth1h.Collect(ch)
+	serviceBackendLastTransition.Collect(ch)
+	serviceBackendConsecutiveFailures.Collect(ch)
+	serviceBackendLatency.Collect(ch)
+	serviceBackendLatencyQuantile.Collect(ch)
 	serviceBackendStatus.Collect(ch)
 	serviceBackendWeight.Collect(ch)
+	serviceBackendDraining.Collect(ch)
+	serviceBackendEjected.Collect(ch)
+	driftEntries.Collect(ch)
 }
 
-func (e *Exporter) collect() error {
+func (e *Exporter) collect(ch chan<- prometheus.Metric) {
+	e.collectServices(ch)
+
+	// Drift reports are replaced by the reconcile goroutine, so only read a snapshot.
+	if report := e.ctx.lastDrift(); report != nil {
+		counts := make(map[string]int)
+		for _, d := range report.Drifts {
+			counts[d.Kind]++
+		}
+		for _, kind := range driftKinds {
+			driftEntries.WithLabelValues(kind).Set(float64(counts[kind]))
+		}
+	}
+}
+
+func (e *Exporter) collectServices(ch chan<- prometheus.Metric) {
 	e.ctx.mutex.RLock()
 	defer e.ctx.mutex.RUnlock()
 
-	for serviceName, _ := range e.ctx.services {
-		service, err := e.ctx.GetService(serviceName)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("error getting service: %s", serviceName))
-		}
+	// IPVS is only listed once per scrape, instead of once per service and backend.
+	vsStats, rsStats, err := e.ctx.allStats()
+	if err != nil {
+		log.Errorf("error while reading IPVS stats: %s", err)
+	}
 
-		serviceHealth.WithLabelValues(serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
-			service.Options.Protocol).
-			Set(service.Health)
+	for serviceName, vs := range e.ctx.services {
+		options := vs.options
+		port := fmt.Sprintf("%d", options.Port)
 
-		serviceBackends.WithLabelValues(serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
-			service.Options.Protocol).
-			Set(float64(len(service.Backends)))
+		var (
+			health   float64
+			backends int
+		)
 
-		for i := 0; i < len(service.Backends); i++ {
-			backendName := service.Backends[i]
-			backend, err := e.ctx.GetBackend(serviceName, backendName)
-			if err != nil {
-				return errors.Wrap(err, fmt.Sprintf("error getting backend %s from service %s", backendName, serviceName))
+		for backendName, rs := range e.ctx.backends {
+			if rs.service != vs {
+				continue
 			}
 
-			serviceBackendUptimeTotal.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Uptime.Seconds())
+			backends++
+			health += rs.metrics.Health
+
+			e.collectBackend(ch, serviceName, backendName, rs, rsStats[rs])
+		}
 
-			serviceBackendHealth.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Health)
+		if backends == 0 {
+			// Service without backends is healthy, albeit useless.
+			health = 1.0
+		} else {
+			health /= float64(backends)
+		}
 
-			serviceBackendStatus.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Metrics.Status))
+		serviceHealth.WithLabelValues(serviceName, options.Host, port, options.Protocol).Set(health)
 
-			serviceBackendWeight.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Options.Weight))
+		panicking := 0.0
+		if vs.panic {
+			panicking = 1.0
 		}
+		servicePanic.WithLabelValues(serviceName, options.Host, port, options.Protocol).Set(panicking)
+
+		fallback := 0.0
+		if vs.fallback {
+			fallback = 1.0
+		}
+		serviceFallback.WithLabelValues(serviceName, options.Host, port, options.Protocol).Set(fallback)
+
+		serviceBackends.WithLabelValues(serviceName, options.Host, port, options.Protocol).Set(float64(backends))
+
+		if stats := vsStats[vs]; stats != nil {
+			serviceStats.collect(ch, stats, serviceName, options.Host, port, options.Protocol)
+		}
+	}
+}
+
+func (e *Exporter) collectBackend(ch chan<- prometheus.Metric, serviceName, backendName string, rs *backend,
+	stats *Stats) {
+	labels := []string{serviceName, backendName, rs.options.Host, fmt.Sprintf("%d", rs.options.Port)}
+	metrics := rs.metrics
+
+	serviceBackendUptimeTotal.WithLabelValues(labels...).Set(metrics.Uptime.Seconds())
+	serviceBackendHealth.WithLabelValues(labels...).Set(metrics.Health)
+	serviceBackendHealth1h.WithLabelValues(labels...).Set(metrics.Health1h)
+	serviceBackendLastTransition.WithLabelValues(labels...).Set(float64(metrics.LastTransition.UnixNano()) / 1e9)
+	serviceBackendConsecutiveFailures.WithLabelValues(labels...).Set(float64(metrics.ConsecutiveFailures))
+	serviceBackendLatency.WithLabelValues(labels...).Set(metrics.Latency.Seconds())
+
+	for quantile, latency := range map[string]time.Duration{
+		"0.5":  metrics.LatencyP50,
+		"0.9":  metrics.LatencyP90,
+		"0.99": metrics.LatencyP99,
+	} {
+		serviceBackendLatencyQuantile.WithLabelValues(append(labels, quantile)...).Set(latency.Seconds())
+	}
+
+	serviceBackendStatus.WithLabelValues(labels...).Set(float64(metrics.Status))
+	serviceBackendWeight.WithLabelValues(labels...).Set(float64(rs.ipvsWeight()))
+
+	draining := 0.0
+	if rs.drain != nil {
+		draining = 1.0
+	}
+	serviceBackendDraining.WithLabelValues(labels...).Set(draining)
+
+	ejected := 0.0
+	if rs.ejection != nil {
+		ejected = 1.0
+	}
+	serviceBackendEjected.WithLabelValues(labels...).Set(ejected)
+
+	if stats != nil {
+		serviceBackendStats.collect(ch, stats, labels...)
 	}
-	return nil
 }
+
 func RegisterPrometheusExporter(ctx *Context) {
 	prometheus.MustRegister(NewExporter(ctx))
 }
@@ -1,13 +1,25 @@
 package core
 
 import (
+	"net"
+	"sort"
 	"testing"
 
+	"github.com/kobolog/gorb/ipvs-shim"
 	"github.com/kobolog/gorb/pulse"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCollector(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockIpvs.On("ListServicesWithDestinations").Return([]*ipvs_shim.Service{{VIP: "127.0.0.1", Port: 1234, Protocol: "tcp",
+		Stats:        ipvs_shim.Stats{Connections: 10},
+		Destinations: []*ipvs_shim.Destination{{Host: "127.0.0.1", Port: 1234, ActiveConns: 2}}}}, nil).Once()
+
 	ctx := &Context{
+		ipvs:     mockIpvs,
 		services: make(map[string]*service),
 		backends: make(map[string]*backend),
 	}
@@ -17,17 +29,46 @@ func TestCollector(t *testing.T) {
 		Protocol:   "tcp",
 		Method:     "wlc",
 		Persistent: true,
+		host:       net.ParseIP("127.0.0.1"),
 	}}
-	ctx.backends["service1-backend1"] = &backend{options: &BackendOptions{
-		Host:   "localhost",
-		Port:   1234,
-		Weight: 1,
-		Method: "nat",
-		VsID:   "service1",
-	}, service: ctx.services["service1"], monitor: &pulse.Pulse{}}
-	exporter := NewExporter(ctx)
-	err := exporter.collect()
+	for _, id := range []string{"service1-backend1", "service1-backend2"} {
+		ctx.backends[id] = &backend{options: &BackendOptions{
+			Host:   "localhost",
+			Port:   1234,
+			Weight: 1,
+			Method: "nat",
+			VsID:   "service1",
+			host:   net.ParseIP("127.0.0.1"),
+		}, service: ctx.services["service1"], monitor: &pulse.Pulse{}}
+	}
+
+	// Latency-scaled weights are exported rather than the configured ones.
+	ctx.backends["service1-backend1"].scaled = 5
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter(ctx))
+
+	families, err := registry.Gather()
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// IPVS is only listed once per scrape.
+	mockIpvs.AssertExpectations(t)
+
+	metrics := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		metrics[family.GetName()] = family
+	}
+
+	assert.Equal(t, dto.MetricType_COUNTER, metrics["gorb_service_connections_total"].GetType())
+	assert.Equal(t, 10.0, metrics["gorb_service_connections_total"].Metric[0].GetCounter().GetValue())
+	assert.Len(t, metrics["gorb_service_backend_active_connections"].Metric, 2)
+
+	var weights []float64
+	for _, m := range metrics["gorb_service_backend_weight"].Metric {
+		weights = append(weights, m.GetGauge().GetValue())
+	}
+	sort.Float64s(weights)
+	assert.Equal(t, []float64{1, 5}, weights)
 }
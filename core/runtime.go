@@ -21,6 +21,9 @@
 package core
 
 import (
+	"math"
+	"time"
+
 	"github.com/kobolog/gorb/pulse"
 
 	log "github.com/Sirupsen/logrus"
@@ -55,6 +58,11 @@ func (ctx *Context) processPulseUpdate(stash map[pulse.ID]uint32, u pulse.Update
 		return
 	}
 
+	if ctx.backends[rsID].ejection != nil && u.Metrics.Status == pulse.StatusUp {
+		// Passively ejected backends stay down until the ejection expires.
+		u.Metrics.Status = pulse.StatusDown
+	}
+
 	if ctx.backends[rsID].metrics.Status != u.Metrics.Status {
 		log.Warnf("backend %s status: %s", u.Source, u.Metrics.Status)
 	}
@@ -62,37 +70,293 @@ func (ctx *Context) processPulseUpdate(stash map[pulse.ID]uint32, u pulse.Update
 	// This is a copy of metrics structure from Pulse.
 	ctx.backends[rsID].metrics = u.Metrics
 
+	if u.Metrics.Status != pulse.StatusUp {
+		ctx.backends[rsID].upSince = time.Time{}
+	} else if ctx.backends[rsID].upSince.IsZero() {
+		ctx.backends[rsID].upSince = time.Now()
+	}
+
+	// Service options are updated in place, so they can only be read with the lock.
+	recovery := *ctx.backends[rsID].service.options
+	elapsed := time.Since(ctx.backends[rsID].upSince)
+
+	if ctx.backends[rsID].drain != nil {
+		// Draining backends keep their zero weight regardless of health.
+		ctx.mutex.Unlock()
+		return
+	}
+
+	vs := ctx.backends[rsID].service
+	panicking, healthy := ctx.panicking(vs)
+
+	ctx.refreshFallback(vsID, vs)
+	entered, left := panicking && !vs.panic, !panicking && vs.panic
+	vs.panic = panicking
+
+	// Backends to restore when entering panic mode, or to stash when leaving it.
+	var affected []pulse.ID
+
+	for id, rs := range ctx.backends {
+		if rs.service != vs {
+			continue
+		}
+
+		source := pulse.ID{VsID: vsID, RsID: id}
+
+		// Weights patched while the backend was stashed are restored instead.
+		if _, exists := stash[source]; exists && rs.patched {
+			stash[source], rs.patched = rs.weight, false
+		}
+
+		if rs.drain == nil && (entered || left && rs.metrics.Status != pulse.StatusUp) {
+			affected = append(affected, source)
+		}
+	}
+
 	ctx.mutex.Unlock()
 
+	if entered {
+		log.Warnf("only %d backend(s) of service [%s] are healthy, routing to all of them", healthy, vsID)
+		ctx.unstashAll(stash, affected)
+		return
+	} else if left {
+		log.Infof("%d backend(s) of service [%s] are healthy again", healthy, vsID)
+		ctx.stashAll(stash, affected)
+	}
+
+	if panicking && u.Metrics.Status == pulse.StatusDown {
+		// Unhealthy backends keep their weights in panic mode.
+		return
+	}
+
 	switch u.Metrics.Status {
 	case pulse.StatusUp:
 		// Weight is gonna be stashed until the backend is recovered.
 		weight, exists := stash[u.Source]
 
 		if !exists {
+			ctx.scaleBackend(vsID, rsID)
 			return
 		}
 
-		// Calculate a relative weight considering backend's health.
-		weight = uint32(float64(weight) * u.Metrics.Health)
+		weight = recoveryWeight(&recovery, weight, u.Metrics.Health, elapsed)
 
-		if _, err := ctx.UpdateBackend(vsID, rsID, weight); err != nil {
+		if err := ctx.unstashBackend(stash, u.Source, weight); err != nil {
 			log.Errorf("error while unstashing a backend: %s", err)
-		} else if weight == stash[u.Source] {
-			log.Debugf("backend %s has completely recovered, so deleting it from stash.", u.Source)
-			// This means that the backend has completely recovered.
-			delete(stash, u.Source)
 		}
 
 	case pulse.StatusDown:
-		if _, exists := stash[u.Source]; exists {
-			return
+		if err := ctx.stashBackend(stash, u.Source); err != nil {
+			log.Errorf("error while stashing a backend: %s", err)
 		}
+	}
+}
+
+// stashBackend sets the weight of a backend to zero, stashing its current weight.
+// The backend is marked as stashed along with the update, so that patches made
+// meanwhile don't bring it back into rotation.
+func (ctx *Context) stashBackend(stash map[pulse.ID]uint32, id pulse.ID) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if _, exists := stash[id]; exists {
+		return nil
+	}
+
+	weight, err := ctx.updateBackend(id.VsID, id.RsID, 0)
+	if err != nil {
+		return err
+	}
+
+	stash[id], ctx.backends[id.RsID].stashed = weight, true
+
+	return nil
+}
+
+// unstashBackend sets the weight of a stashed backend, which is only deleted from
+// the stash once the stashed weight has been restored.
+func (ctx *Context) unstashBackend(stash map[pulse.ID]uint32, id pulse.ID, weight uint32) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if _, err := ctx.updateBackend(id.VsID, id.RsID, weight); err != nil {
+		return err
+	}
+
+	if weight == stash[id] {
+		log.Debugf("backend %s has completely recovered, so deleting it from stash.", id)
+		delete(stash, id)
+		ctx.backends[id.RsID].stashed = false
+	}
+
+	return nil
+}
+
+// recoveryWeight calculates the current weight of a backend which has been up for
+// the elapsed time after a failure, using the recovery policy of its service.
+func recoveryWeight(opts *ServiceOptions, weight uint32, health float64, elapsed time.Duration) uint32 {
+	var progress float64
+
+	if weight == 0 {
+		return 0
+	} else if opts.recoveryPeriod > 0 {
+		progress = math.Min(1, float64(elapsed)/float64(opts.recoveryPeriod))
+	}
+
+	switch opts.Recovery {
+	case RecoveryImmediate:
+		return weight
+	case RecoveryLinear:
+		// At least some traffic is let through from the start.
+		return uint32(math.Max(1, float64(weight)*progress))
+	case RecoveryExponential:
+		// Grows from 1 to the full weight.
+		return uint32(math.Pow(float64(weight), progress))
+	default:
+		// Relative to the backend's health check history.
+		return uint32(float64(weight) * health)
+	}
+}
 
-		if weight, err := ctx.UpdateBackend(vsID, rsID, 0); err != nil {
+// Latency-aware weights are only updated if they change by more than a tenth.
+const latencyWeightTolerance = 0.1
+
+// scaleBackend updates the weight of a healthy backend if its service has
+// latency-aware weighting.
+func (ctx *Context) scaleBackend(vsID, rsID string) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	rs, exists := ctx.backends[rsID]
+	if !exists || rs.drain != nil || !rs.service.options.LatencyWeighting {
+		return
+	}
+
+	weight, current := ctx.latencyWeight(rs), rs.ipvsWeight()
+
+	if math.Abs(float64(weight)-float64(current)) <= latencyWeightTolerance*float64(current) {
+		return
+	}
+
+	log.Infof("scaling backend [%s/%s] to weight %d by latency", vsID, rsID, weight)
+
+	// Only IPVS is updated, so that the configured weight is kept in the options.
+	if err := ctx.ipvs.UpdateDestPort(
+		rs.service.options.host.String(),
+		rs.service.options.Port,
+		rs.options.host.String(),
+		rs.options.Port,
+		rs.service.options.Protocol,
+		rs.service.options.FwMark,
+		weight,
+		rs.options.Method,
+	); err != nil {
+		log.Errorf("error while scaling backend [%s/%s]: %s", vsID, rsID, err)
+		return
+	}
+
+	rs.scaled = weight
+}
+
+// latencyWeight scales the configured weight of a backend by the ratio of the
+// lowest median check latency among healthy backends of its service to its own.
+func (ctx *Context) latencyWeight(rs *backend) uint32 {
+	latency := rs.metrics.LatencyP50
+	if latency <= 0 || rs.weight == 0 {
+		return rs.weight
+	}
+
+	fastest := latency
+
+	for _, other := range ctx.backends {
+		// No-op pulses don't measure anything.
+		if other.service != rs.service || other.metrics.Status != pulse.StatusUp ||
+			other.options.Pulse == nil || other.options.Pulse.Type == "none" {
+			continue
+		}
+
+		if l := other.metrics.LatencyP50; l > 0 && l < fastest {
+			fastest = l
+		}
+	}
+
+	// At least some traffic is let through to slow backends.
+	return uint32(math.Max(1, float64(rs.weight)*float64(fastest)/float64(latency)))
+}
+
+// panicking returns whether fewer backends of a service are healthy than required,
+// and the number of healthy backends. Services with a fallback backend don't panic
+// once none of their backends are healthy, the fallback backend serves alone.
+func (ctx *Context) panicking(vs *service) (bool, int) {
+	healthy := 0
+
+	for _, rs := range ctx.backends {
+		if rs.service == vs && rs.drain == nil && rs.metrics.Status == pulse.StatusUp {
+			healthy++
+		}
+	}
+
+	if healthy == 0 && vs.options.Fallback != nil {
+		return false, healthy
+	}
+
+	return vs.options.MinHealthy > 0 && healthy < vs.options.MinHealthy, healthy
+}
+
+// unstashAll restores the weights of stashed backends.
+func (ctx *Context) unstashAll(stash map[pulse.ID]uint32, ids []pulse.ID) {
+	for _, id := range ids {
+		weight, exists := stash[id]
+		if !exists {
+			continue
+		}
+
+		if err := ctx.unstashBackend(stash, id, weight); err != nil {
+			log.Errorf("error while unstashing a backend: %s", err)
+		}
+	}
+}
+
+// stashAll sets the weights of backends to zero, stashing their current weights.
+func (ctx *Context) stashAll(stash map[pulse.ID]uint32, ids []pulse.ID) {
+	for _, id := range ids {
+		if err := ctx.stashBackend(stash, id); err != nil {
 			log.Errorf("error while stashing a backend: %s", err)
-		} else {
-			stash[u.Source] = weight
 		}
 	}
 }
+
+// refreshFallback adds the fallback backend of a service while none of its backends
+// are healthy, and removes it otherwise. The caller must hold the mutex.
+func (ctx *Context) refreshFallback(vsID string, vs *service) {
+	_, healthy := ctx.panicking(vs)
+	ctx.setFallback(vsID, vs, healthy == 0)
+}
+
+// setFallback adds or removes the fallback backend of a service. Failures are only
+// logged, the change is retried on the next pulse update.
+func (ctx *Context) setFallback(vsID string, vs *service, active bool) {
+	opts := vs.options.Fallback
+	if active == vs.fallback || opts == nil {
+		return
+	}
+
+	var err error
+
+	if active {
+		log.Warnf("no backends of service [%s] are healthy, adding fallback backend %s", vsID, opts.host)
+		err = ctx.ipvs.AddDestPort(vs.options.host.String(), vs.options.Port, opts.host.String(), opts.Port,
+			vs.options.Protocol, vs.options.FwMark, opts.Weight, opts.Method)
+	} else {
+		log.Infof("removing fallback backend %s of service [%s]", opts.host, vsID)
+		err = ctx.ipvs.DelDestPort(vs.options.host.String(), vs.options.Port, opts.host.String(), opts.Port,
+			vs.options.Protocol, vs.options.FwMark)
+	}
+
+	if err != nil {
+		log.Errorf("error while updating fallback backend of service [%s]: %s", vsID, err)
+		return
+	}
+
+	vs.fallback = active
+}
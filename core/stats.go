@@ -0,0 +1,139 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+
+	"github.com/kobolog/gorb/ipvs-shim"
+)
+
+// Stats contains IPVS connection and traffic statistics of a virtual service or a
+// backend. Connection counts of a service are the sums over its backends.
+type Stats struct {
+	ActiveConns   uint32 `json:"active_conns"`
+	InactiveConns uint32 `json:"inactive_conns"`
+	PersistConns  uint32 `json:"persistent_conns"`
+
+	ipvs_shim.Stats
+}
+
+// findDestination looks up the IPVS entry for a backend.
+func findDestination(dests []*ipvs_shim.Destination, opts *BackendOptions) *ipvs_shim.Destination {
+	for _, dest := range dests {
+		if opts.host.Equal(net.ParseIP(dest.Host)) && dest.Port == opts.Port {
+			return dest
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) listDestinations(vs *service) ([]*ipvs_shim.Destination, error) {
+	opts := vs.options
+	return ctx.ipvs.ListDestinations(opts.host.String(), opts.Port, opts.Protocol, opts.FwMark)
+}
+
+// serviceStats reads virtual service statistics from IPVS.
+func (ctx *Context) serviceStats(vs *service) (*Stats, error) {
+	opts := vs.options
+
+	svc, err := ctx.ipvs.GetService(opts.host.String(), opts.Port, opts.Protocol, opts.FwMark)
+	if err != nil {
+		return nil, err
+	}
+
+	dests, err := ctx.listDestinations(vs)
+	if err != nil {
+		return nil, err
+	}
+
+	return newServiceStats(svc, dests), nil
+}
+
+func newServiceStats(svc *ipvs_shim.Service, dests []*ipvs_shim.Destination) *Stats {
+	stats := &Stats{Stats: svc.Stats}
+
+	for _, dest := range dests {
+		stats.ActiveConns += dest.ActiveConns
+		stats.InactiveConns += dest.InactiveConns
+		stats.PersistConns += dest.PersistConns
+	}
+
+	return stats
+}
+
+func newBackendStats(dest *ipvs_shim.Destination) *Stats {
+	return &Stats{
+		ActiveConns:   dest.ActiveConns,
+		InactiveConns: dest.InactiveConns,
+		PersistConns:  dest.PersistConns,
+		Stats:         dest.Stats,
+	}
+}
+
+// backendStats reads backend statistics from IPVS.
+func (ctx *Context) backendStats(rs *backend) (*Stats, error) {
+	dests, err := ctx.listDestinations(rs.service)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := findDestination(dests, rs.options)
+	if dest == nil {
+		return nil, ErrObjectNotFound
+	}
+
+	return newBackendStats(dest), nil
+}
+
+// allStats reads statistics of all virtual services and their backends with a
+// single IPVS listing. The caller must hold the mutex. Services which can't be
+// found in IPVS are left out.
+func (ctx *Context) allStats() (map[*service]*Stats, map[*backend]*Stats, error) {
+	svcs, err := ctx.ipvs.ListServicesWithDestinations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	services := make(map[*service]*Stats, len(ctx.services))
+	backends := make(map[*backend]*Stats, len(ctx.backends))
+
+	for _, vs := range ctx.services {
+		svc := findService(svcs, vs.options)
+		if svc == nil {
+			continue
+		}
+
+		dests := svc.Destinations
+		services[vs] = newServiceStats(svc, dests)
+
+		for _, rs := range ctx.backends {
+			if rs.service != vs {
+				continue
+			}
+			if dest := findDestination(dests, rs.options); dest != nil {
+				backends[rs] = newBackendStats(dest)
+			}
+		}
+	}
+
+	return services, backends, nil
+}
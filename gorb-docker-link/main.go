@@ -119,8 +119,8 @@ func createBackend(vs, rs string, b gdc.APIPort) error {
 	opts := core.BackendOptions{Host: b.IP, Port: uint16(b.PublicPort)}
 
 	if b.Type == "udp" {
-		// Disable pulse for UDP backends.
-		opts.Pulse = &pulse.Options{Type: "none"}
+		// UDP backends are only checked for unreachable ports.
+		opts.Pulse = &pulse.Options{Type: "udp"}
 	}
 
 	data := bytes.NewBuffer(util.MustMarshal(opts, util.JSONOptions{}))
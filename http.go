@@ -23,8 +23,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/kobolog/gorb/core"
+	"github.com/kobolog/gorb/pulse"
 	"github.com/kobolog/gorb/util"
 
 	"github.com/gorilla/mux"
@@ -45,7 +47,7 @@ func writeError(w http.ResponseWriter, err error) {
 	switch err {
 	case core.ErrIpvsSyscallFailed:
 		code = http.StatusInternalServerError
-	case core.ErrObjectExists:
+	case core.ErrObjectExists, core.ErrBackendDraining, core.ErrFallbackIsBackend:
 		code = http.StatusConflict
 	case core.ErrObjectNotFound:
 		code = http.StatusNotFound
@@ -114,14 +116,27 @@ type backendUpdateHandler struct {
 }
 
 func (h backendUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var (
-		opts core.BackendOptions
-		vars = mux.Vars(r)
-	)
+	vars := mux.Vars(r)
 
-	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+	// Options missing from the request keep their current values.
+	opts, err := h.ctx.GetBackendOptions(vars["vsID"], vars["rsID"])
+	if err != nil {
 		writeError(w, err)
-	} else if _, err := h.ctx.UpdateBackend(vars["vsID"], vars["rsID"], opts.Weight); err != nil {
+		return
+	}
+
+	// The pulse is replaced as a whole, otherwise its args could never be removed.
+	current := opts.Pulse
+	opts.Pulse = nil
+
+	if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+		writeError(w, err)
+		return
+	} else if opts.Pulse == nil {
+		opts.Pulse = current
+	}
+
+	if err := h.ctx.PatchBackend(vars["vsID"], vars["rsID"], opts); err != nil {
 		writeError(w, err)
 	}
 }
@@ -145,7 +160,16 @@ type backendRemoveHandler struct {
 func (h backendRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	if _, err := h.ctx.RemoveBackend(vars["vsID"], vars["rsID"]); err != nil {
+	if drain := r.URL.Query().Get("drain"); len(drain) > 0 {
+		if timeout, err := util.ParseInterval(drain); err != nil {
+			writeError(w, err)
+		} else if err := h.ctx.DrainBackend(vars["vsID"], vars["rsID"], timeout); err != nil {
+			writeError(w, err)
+		} else {
+			// The backend is removed once it's drained.
+			w.WriteHeader(http.StatusAccepted)
+		}
+	} else if _, err := h.ctx.RemoveBackend(vars["vsID"], vars["rsID"]); err != nil {
 		writeError(w, err)
 	}
 }
@@ -189,3 +213,59 @@ func (h backendStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		writeJSON(w, opts)
 	}
 }
+
+type driftHandler struct {
+	ctx *core.Context
+}
+
+func (h driftHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if report, err := h.ctx.Drift(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, report)
+	}
+}
+
+type connectionListHandler struct {
+	ctx *core.Context
+}
+
+func (h connectionListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		vars   = mux.Vars(r)
+		query  = r.URL.Query()
+		filter = core.ConnectionFilter{Client: query.Get("client"), State: query.Get("state")}
+		err    error
+	)
+
+	if v := query.Get("offset"); len(v) > 0 {
+		if filter.Offset, err = strconv.Atoi(v); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if v := query.Get("limit"); len(v) > 0 {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if filter.Offset < 0 || filter.Limit < 0 {
+		writeError(w, core.ErrInvalidPagination)
+		return
+	}
+
+	if list, err := h.ctx.ListConnections(vars["vsID"], vars["rsID"], filter); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, list)
+	}
+}
+
+type pulseDriverListHandler struct{}
+
+func (h pulseDriverListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, pulse.Drivers())
+}
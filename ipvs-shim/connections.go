@@ -0,0 +1,101 @@
+package ipvs_shim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The connection table isn't available via netlink, only via procfs.
+var connTablePath = "/proc/net/ip_vs_conn"
+
+// Connection describes an entry of the IPVS connection table.
+type Connection struct {
+	Protocol   string
+	Client     string
+	ClientPort uint16
+	VIP        string
+	VPort      uint16
+	Dest       string
+	DPort      uint16
+	State      string
+	Expires    time.Duration
+}
+
+func (s *shim) ListConnections() ([]*Connection, error) {
+	f, err := os.Open(connTablePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConnections(f)
+}
+
+// parseConnections parses the connection table format, e.g.:
+//
+//	Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+//	TCP 0A000001 D431 0A000064 0050 0A000002 1F90 ESTABLISHED     898
+//
+// IPv4 addresses are hexadecimal, IPv6 ones are in their full notation.
+func parseConnections(r io.Reader) ([]*Connection, error) {
+	var result []*Connection
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if line == 1 && len(fields) > 0 && fields[0] == "Pro" {
+			continue
+		} else if len(fields) == 0 {
+			continue
+		} else if len(fields) < 9 {
+			return nil, fmt.Errorf("malformed connection entry on line %d", line)
+		}
+		conn := &Connection{
+			Protocol: strings.ToLower(fields[0]),
+			State:    fields[7],
+		}
+		var err error
+		if conn.Client, conn.ClientPort, err = parseConnEndpoint(fields[1], fields[2]); err != nil {
+			return nil, fmt.Errorf("malformed connection entry on line %d: %s", line, err)
+		}
+		if conn.VIP, conn.VPort, err = parseConnEndpoint(fields[3], fields[4]); err != nil {
+			return nil, fmt.Errorf("malformed connection entry on line %d: %s", line, err)
+		}
+		if conn.Dest, conn.DPort, err = parseConnEndpoint(fields[5], fields[6]); err != nil {
+			return nil, fmt.Errorf("malformed connection entry on line %d: %s", line, err)
+		}
+		expires, err := strconv.ParseUint(fields[8], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed connection entry on line %d: %s", line, err)
+		}
+		conn.Expires = time.Duration(expires) * time.Second
+		result = append(result, conn)
+	}
+	return result, scanner.Err()
+}
+
+func parseConnEndpoint(addr, port string) (string, uint16, error) {
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	if strings.Contains(addr, ":") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return "", 0, fmt.Errorf("invalid address %q", addr)
+		}
+		return ip.String(), uint16(p), nil
+	}
+	a, err := strconv.ParseUint(addr, 16, 32)
+	if err != nil {
+		return "", 0, err
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(a))
+	return ip.String(), uint16(p), nil
+}
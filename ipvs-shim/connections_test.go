@@ -0,0 +1,36 @@
+package ipvs_shim
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConnections(t *testing.T) {
+	table := `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000001 D431 0A000064 0050 0A000002 1F90 ESTABLISHED     898
+UDP fd11:bcb5:61df:0000:0000:0000:0000:0009 0035 fd11:bcb5:61df:0000:0000:0000:0000:0001 0035 fd11:bcb5:61df:0000:0000:0000:0000:0002 0035 UDP             295 sip abc
+`
+	conns, err := parseConnections(strings.NewReader(table))
+	require.NoError(t, err)
+	assert.Equal(t, []*Connection{
+		{Protocol: "tcp", Client: "10.0.0.1", ClientPort: 54321, VIP: "10.0.0.100", VPort: 80,
+			Dest: "10.0.0.2", DPort: 8080, State: "ESTABLISHED", Expires: 898 * time.Second},
+		{Protocol: "udp", Client: "fd11:bcb5:61df::9", ClientPort: 53, VIP: "fd11:bcb5:61df::1", VPort: 53,
+			Dest: "fd11:bcb5:61df::2", DPort: 53, State: "UDP", Expires: 295 * time.Second},
+	}, conns)
+}
+
+func TestParseConnectionsRejectsMalformedEntries(t *testing.T) {
+	for _, table := range []string{
+		"TCP 0A000001 D431 0A000064 0050\n",
+		"TCP 0A00000Z D431 0A000064 0050 0A000002 1F90 ESTABLISHED 898\n",
+		"TCP 0A000001 D431 0A000064 0050 0A000002 1F90 ESTABLISHED -1\n",
+	} {
+		_, err := parseConnections(strings.NewReader(table))
+		assert.Error(t, err, table)
+	}
+}
@@ -2,15 +2,24 @@
 package ipvs_shim
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
+	"strconv"
 	"syscall"
+	"unsafe"
 
 	"fmt"
 
+	"github.com/kobolog/gorb/util"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/mqliang/libipvs"
 )
 
+// ErrServiceNotFound is returned when a virtual service is not in the IPVS table.
+var ErrServiceNotFound = errors.New("virtual service not found")
+
 var (
 	schedulerFlags = map[string]uint32{
 		"sh-fallback": libipvs.IP_VS_SVC_F_SCHED_SH_FALLBACK,
@@ -26,17 +35,92 @@ var (
 		"tunnel": libipvs.IP_VS_CONN_F_TUNNEL,
 		"ipip":   libipvs.IP_VS_CONN_F_TUNNEL,
 	}
+
+	// Netlink attributes are encoded in host byte order.
+	nativeEndian = func() binary.ByteOrder {
+		x := uint16(1)
+		if *(*byte)(unsafe.Pointer(&x)) == 1 {
+			return binary.LittleEndian
+		}
+		return binary.BigEndian
+	}()
 )
 
 type IPVS interface {
 	Init() error
 	Flush() error
-	AddService(vip string, port uint16, protocol string, sched string, flags []string) error
-	UpdateService(vip string, port uint16, protocol string, sched string, flags []string) error
-	DelService(vip string, port uint16, protocol string) error
-	AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error
-	UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error
-	DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string) error
+	AddService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error
+	UpdateService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error
+	DelService(vip string, port uint16, protocol string, fwmark uint32) error
+	AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error
+	UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error
+	DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32) error
+	ListServices() ([]*Service, error)
+	ListServicesWithDestinations() ([]*Service, error)
+	GetService(vip string, port uint16, protocol string, fwmark uint32) (*Service, error)
+	ListDestinations(vip string, port uint16, protocol string, fwmark uint32) ([]*Destination, error)
+	ListConnections() ([]*Connection, error)
+}
+
+// Service describes a virtual service as found in the IPVS table. Firewall mark
+// services have no VIP, port or protocol, only an address family.
+type Service struct {
+	VIP      string
+	Port     uint16
+	Protocol string
+	FwMark   uint32
+	Family   int
+	Sched    string
+	Flags    []string
+	Timeout  uint32
+	Netmask  uint8
+	Stats    Stats
+
+	// Only set by ListServicesWithDestinations.
+	Destinations []*Destination
+}
+
+// Destination describes a virtual service backend as found in the IPVS table.
+type Destination struct {
+	Host   string
+	Port   uint16
+	Weight uint32
+	Fwd    string
+
+	ActiveConns   uint32
+	InactiveConns uint32
+	PersistConns  uint32
+	Stats         Stats
+}
+
+// Stats contains IPVS traffic counters and rates, the latter are estimated by the
+// kernel over the last couple of seconds.
+type Stats struct {
+	Connections uint32 `json:"connections"`
+	PacketsIn   uint32 `json:"packets_in"`
+	PacketsOut  uint32 `json:"packets_out"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+	CPS         uint32 `json:"cps"`
+	PPSIn       uint32 `json:"pps_in"`
+	PPSOut      uint32 `json:"pps_out"`
+	BPSIn       uint32 `json:"bps_in"`
+	BPSOut      uint32 `json:"bps_out"`
+}
+
+func newStats(stats libipvs.Stats) Stats {
+	return Stats{
+		Connections: stats.Connections,
+		PacketsIn:   stats.PacketsIn,
+		PacketsOut:  stats.PacketsOut,
+		BytesIn:     stats.BytesIn,
+		BytesOut:    stats.BytesOut,
+		CPS:         stats.CPS,
+		PPSIn:       stats.PPSIn,
+		PPSOut:      stats.PPSOut,
+		BPSIn:       stats.BPSIn,
+		BPSOut:      stats.BPSOut,
+	}
 }
 
 type shim struct {
@@ -64,6 +148,23 @@ func ValidForwarding(fwd string) bool {
 	return exists
 }
 
+// SameFlags checks whether two lists of flag names set the same scheduler flags.
+func SameFlags(a, b []string) bool {
+	var x, y uint32
+	for _, flag := range a {
+		x |= schedulerFlags[flag]
+	}
+	for _, flag := range b {
+		y |= schedulerFlags[flag]
+	}
+	return x == y
+}
+
+// SameForwarding checks whether two forwarding method names are the same method.
+func SameForwarding(a, b string) bool {
+	return backendForwarding[a] == backendForwarding[b]
+}
+
 func (s *shim) Init() error {
 	h, err := libipvs.New()
 	if err != nil {
@@ -77,20 +178,80 @@ func (s *shim) Flush() error {
 	return s.handle.Flush()
 }
 
-func createSvcKey(vip string, protocol string, port uint16) (*libipvs.Service, error) {
+func parseAddr(addr string) (net.IP, libipvs.AddressFamily, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP address %q", addr)
+	}
+	af := util.AddrFamily(ip)
+	if af == util.IPv4 {
+		// The kernel expects 4-byte addresses for AF_INET entries.
+		ip = ip.To4()
+	}
+	return ip, libipvs.AddressFamily(af), nil
+}
+
+// createSvcKey creates a service key. Services with a non-zero fwmark are keyed
+// by the mark instead, and vip is only used to determine the address family.
+func createSvcKey(vip string, protocol string, port uint16, fwmark uint32) (*libipvs.Service, error) {
 	protNum, err := protocolNumber(protocol)
 	if err != nil {
 		return nil, err
 	}
+	addr, af, err := parseAddr(vip)
+	if err != nil {
+		return nil, err
+	}
+	if fwmark != 0 {
+		svc := &libipvs.Service{
+			FWMark:        fwmark,
+			AddressFamily: af,
+			Netmask:       hostNetmask(af),
+		}
+		return svc, nil
+	}
 	svc := &libipvs.Service{
-		Address:       net.ParseIP(vip),
+		Address:       addr,
 		Protocol:      libipvs.Protocol(protNum),
 		Port:          port,
-		AddressFamily: syscall.AF_INET,
+		AddressFamily: af,
+		Netmask:       hostNetmask(af),
 	}
 	return svc, nil
 }
 
+// hostNetmask returns a single host netmask in the format expected by the kernel:
+// a mask for AF_INET and a prefix length for AF_INET6 (which must be set).
+func hostNetmask(af libipvs.AddressFamily) uint32 {
+	if af == syscall.AF_INET6 {
+		return 128
+	}
+	return 0xffffffff
+}
+
+// persistenceNetmask converts a persistence prefix length into the kernel netmask
+// format, defaulting to a single host netmask if the prefix length is not set.
+func persistenceNetmask(af libipvs.AddressFamily, prefix uint8) uint32 {
+	if prefix == 0 {
+		return hostNetmask(af)
+	}
+	if af == syscall.AF_INET6 {
+		return uint32(prefix)
+	}
+	// The kernel reads an IPv4 netmask as a big-endian value.
+	return nativeEndian.Uint32(net.CIDRMask(int(prefix), 8*net.IPv4len))
+}
+
+// setPersistence enables persistence on a service if timeout (in seconds) is set.
+func setPersistence(svc *libipvs.Service, timeout uint32, netmask uint8) {
+	if timeout == 0 {
+		return
+	}
+	svc.Flags.Flags |= libipvs.IP_VS_SVC_F_PERSISTENT
+	svc.Timeout = timeout
+	svc.Netmask = persistenceNetmask(svc.AddressFamily, netmask)
+}
+
 func createFlagbits(flags []string) uint32 {
 	var flagbits uint32
 	for _, flag := range flags {
@@ -103,61 +264,84 @@ func createFlagbits(flags []string) uint32 {
 	return flagbits
 }
 
+func protocolName(number libipvs.Protocol) string {
+	switch number {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_SCTP:
+		return "sctp"
+	default:
+		return strconv.Itoa(int(number))
+	}
+}
+
 func protocolNumber(protocol string) (uint16, error) {
 	switch protocol {
 	case "tcp":
 		return syscall.IPPROTO_TCP, nil
 	case "udp":
 		return syscall.IPPROTO_UDP, nil
+	case "sctp":
+		return syscall.IPPROTO_SCTP, nil
 	default:
 		return 0, fmt.Errorf("unknown protocol %q", protocol)
 	}
 }
 
-func (s *shim) AddService(vip string, port uint16, protocol string, sched string, flags []string) error {
+// AddService creates a virtual service. A non-zero timeout (in seconds) makes it persistent,
+// with client addresses grouped by the netmask prefix length.
+func (s *shim) AddService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error {
 	log.Infof("flags: %v", flags)
-	svc, err := createSvcKey(vip, protocol, port)
+	svc, err := createSvcKey(vip, protocol, port, fwmark)
 	if err != nil {
 		return err
 	}
 	svc.SchedName = sched
 	svc.Flags.Flags = createFlagbits(flags)
 	svc.Flags.Mask = ^uint32(0)
+	setPersistence(svc, timeout, netmask)
 	return s.handle.NewService(svc)
 }
 
-func (s *shim) UpdateService(vip string, port uint16, protocol string, sched string, flags []string) error {
-	svc, err := createSvcKey(vip, protocol, port)
+func (s *shim) UpdateService(vip string, port uint16, protocol string, fwmark uint32, sched string, flags []string, timeout uint32, netmask uint8) error {
+	svc, err := createSvcKey(vip, protocol, port, fwmark)
 	if err != nil {
 		return err
 	}
 	svc.SchedName = sched
 	svc.Flags.Flags = createFlagbits(flags)
 	svc.Flags.Mask = ^uint32(0)
+	setPersistence(svc, timeout, netmask)
 	return s.handle.UpdateService(svc)
 }
 
-func (s *shim) DelService(vip string, port uint16, protocol string) error {
-	svc, err := createSvcKey(vip, protocol, port)
+func (s *shim) DelService(vip string, port uint16, protocol string, fwmark uint32) error {
+	svc, err := createSvcKey(vip, protocol, port, fwmark)
 	if err != nil {
 		return err
 	}
 	return s.handle.DelService(svc)
 }
 
-func createDest(rip string, rport uint16, fwd uint32, weight uint32) *libipvs.Destination {
+func createDest(rip string, rport uint16, fwd uint32, weight uint32) (*libipvs.Destination, error) {
+	addr, af, err := parseAddr(rip)
+	if err != nil {
+		return nil, err
+	}
 	dest := &libipvs.Destination{
-		Address:       net.ParseIP(rip),
+		Address:       addr,
 		Port:          rport,
-		AddressFamily: syscall.AF_INET,
+		AddressFamily: af,
 		FwdMethod:     libipvs.FwdMethod(fwd),
 		Weight:        weight,
 	}
-	return dest
+	return dest, nil
 }
 
-func (s *shim) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error {
-	svc, err := createSvcKey(vip, protocol, vport)
+func (s *shim) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error {
+	svc, err := createSvcKey(vip, protocol, vport, fwmark)
 	if err != nil {
 		return err
 	}
@@ -165,12 +349,15 @@ func (s *shim) AddDestPort(vip string, vport uint16, rip string, rport uint16, p
 	if !ok {
 		return fmt.Errorf("invalid forwarding method %q", fwd)
 	}
-	dest := createDest(rip, rport, fwdbits, weight)
+	dest, err := createDest(rip, rport, fwdbits, weight)
+	if err != nil {
+		return err
+	}
 	return s.handle.NewDestination(svc, dest)
 }
 
-func (s *shim) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, weight uint32, fwd string) error {
-	svc, err := createSvcKey(vip, protocol, vport)
+func (s *shim) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32, weight uint32, fwd string) error {
+	svc, err := createSvcKey(vip, protocol, vport, fwmark)
 	if err != nil {
 		return err
 	}
@@ -178,15 +365,189 @@ func (s *shim) UpdateDestPort(vip string, vport uint16, rip string, rport uint16
 	if !ok {
 		return fmt.Errorf("invalid forwarding method %q", fwd)
 	}
-	dest := createDest(rip, rport, fwdbits, weight)
+	dest, err := createDest(rip, rport, fwdbits, weight)
+	if err != nil {
+		return err
+	}
 	return s.handle.UpdateDestination(svc, dest)
 }
 
-func (s *shim) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string) error {
-	svc, err := createSvcKey(vip, protocol, vport)
+func (s *shim) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol string, fwmark uint32) error {
+	svc, err := createSvcKey(vip, protocol, vport, fwmark)
+	if err != nil {
+		return err
+	}
+	dest, err := createDest(rip, rport, 0, 0)
 	if err != nil {
 		return err
 	}
-	dest := createDest(rip, rport, 0, 0)
 	return s.handle.DelDestination(svc, dest)
 }
+
+// flagNames converts service flag bits back into scheduler flag names, using the
+// scheduler specific names for the source hashing scheduler.
+func flagNames(sched string, flagbits uint32) []string {
+	var flags []string
+	names := []struct {
+		bit  uint32
+		name string
+	}{
+		{libipvs.IP_VS_SVC_F_SCHED1, "flag-1"},
+		{libipvs.IP_VS_SVC_F_SCHED2, "flag-2"},
+		{libipvs.IP_VS_SVC_F_SCHED3, "flag-3"},
+	}
+	for _, n := range names {
+		if flagbits&n.bit == 0 {
+			continue
+		}
+		switch {
+		case sched == "sh" && n.bit == libipvs.IP_VS_SVC_F_SCHED_SH_FALLBACK:
+			flags = append(flags, "sh-fallback")
+		case sched == "sh" && n.bit == libipvs.IP_VS_SVC_F_SCHED_SH_PORT:
+			flags = append(flags, "sh-port")
+		default:
+			flags = append(flags, n.name)
+		}
+	}
+	return flags
+}
+
+// netmaskPrefix converts a kernel netmask back into a prefix length.
+func netmaskPrefix(af libipvs.AddressFamily, netmask uint32) uint8 {
+	if af == syscall.AF_INET6 {
+		return uint8(netmask)
+	}
+	mask := make([]byte, net.IPv4len)
+	nativeEndian.PutUint32(mask, netmask)
+	ones, _ := net.IPMask(mask).Size()
+	return uint8(ones)
+}
+
+func fwdName(fwd libipvs.FwdMethod) string {
+	switch uint32(fwd) & libipvs.IP_VS_CONN_F_FWD_MASK {
+	case libipvs.IP_VS_CONN_F_MASQ:
+		return "nat"
+	case libipvs.IP_VS_CONN_F_DROUTE:
+		return "dr"
+	case libipvs.IP_VS_CONN_F_TUNNEL:
+		return "tunnel"
+	default:
+		return strconv.Itoa(int(fwd))
+	}
+}
+
+func newService(svc *libipvs.Service) *Service {
+	result := &Service{
+		Port:   svc.Port,
+		FwMark: svc.FWMark,
+		Family: int(svc.AddressFamily),
+		Sched:  svc.SchedName,
+		Flags:  flagNames(svc.SchedName, svc.Flags.Flags),
+		Stats:  newStats(svc.Stats),
+	}
+	if svc.FWMark == 0 {
+		result.VIP = svc.Address.String()
+		result.Protocol = protocolName(svc.Protocol)
+	}
+	if svc.Flags.Flags&libipvs.IP_VS_SVC_F_PERSISTENT != 0 {
+		result.Timeout = svc.Timeout
+		result.Netmask = netmaskPrefix(svc.AddressFamily, svc.Netmask)
+	}
+	return result
+}
+
+// sameService checks whether a kernel service matches a service key.
+func sameService(svc, key *libipvs.Service) bool {
+	if svc.AddressFamily != key.AddressFamily || svc.FWMark != key.FWMark {
+		return false
+	}
+	return key.FWMark != 0 ||
+		(svc.Address.Equal(key.Address) && svc.Port == key.Port && svc.Protocol == key.Protocol)
+}
+
+func (s *shim) ListServices() ([]*Service, error) {
+	svcs, err := s.handle.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Service, 0, len(svcs))
+	for _, svc := range svcs {
+		result = append(result, newService(svc))
+	}
+	return result, nil
+}
+
+// getService looks up the kernel copy of a service, which is required to list
+// its destinations.
+func (s *shim) getService(vip string, port uint16, protocol string, fwmark uint32) (*libipvs.Service, error) {
+	key, err := createSvcKey(vip, protocol, port, fwmark)
+	if err != nil {
+		return nil, err
+	}
+	svcs, err := s.handle.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range svcs {
+		if sameService(svc, key) {
+			return svc, nil
+		}
+	}
+	return nil, ErrServiceNotFound
+}
+
+func (s *shim) GetService(vip string, port uint16, protocol string, fwmark uint32) (*Service, error) {
+	svc, err := s.getService(vip, port, protocol, fwmark)
+	if err != nil {
+		return nil, err
+	}
+	return newService(svc), nil
+}
+
+func (s *shim) ListDestinations(vip string, port uint16, protocol string, fwmark uint32) ([]*Destination, error) {
+	svc, err := s.getService(vip, port, protocol, fwmark)
+	if err != nil {
+		return nil, err
+	}
+	return s.listDestinations(svc)
+}
+
+func (s *shim) listDestinations(svc *libipvs.Service) ([]*Destination, error) {
+	dests, err := s.handle.ListDestinations(svc)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Destination, 0, len(dests))
+	for _, dest := range dests {
+		result = append(result, &Destination{
+			Host:   dest.Address.String(),
+			Port:   dest.Port,
+			Weight: dest.Weight,
+			Fwd:    fwdName(dest.FwdMethod),
+
+			ActiveConns:   dest.ActiveConns,
+			InactiveConns: dest.InactConns,
+			PersistConns:  dest.PersistConns,
+			Stats:         newStats(dest.Stats),
+		})
+	}
+	return result, nil
+}
+
+// ListServicesWithDestinations lists all services along with their destinations,
+// dumping the service table only once instead of once per service.
+func (s *shim) ListServicesWithDestinations() ([]*Service, error) {
+	svcs, err := s.handle.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Service, 0, len(svcs))
+	for _, svc := range svcs {
+		r := newService(svc)
+		if r.Destinations, err = s.listDestinations(svc); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
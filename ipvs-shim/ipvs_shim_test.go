@@ -1,6 +1,9 @@
 package ipvs_shim
 
 import (
+	"net"
+	"reflect"
+	"syscall"
 	"testing"
 
 	"github.com/mqliang/libipvs"
@@ -31,3 +34,156 @@ func TestCreateFlagbits(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateSvcKeyAddressFamily(t *testing.T) {
+	tests := []struct {
+		name    string
+		vip     string
+		want    libipvs.AddressFamily
+		len     int
+		netmask uint32
+	}{
+		{"ipv4", "10.0.0.1", syscall.AF_INET, net.IPv4len, 0xffffffff},
+		{"ipv6", "fd11:bcb5:61df::1", syscall.AF_INET6, net.IPv6len, 128},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := createSvcKey(tt.vip, "tcp", 80, 0)
+			if err != nil {
+				t.Fatalf("createSvcKey() error = %v", err)
+			}
+			if svc.AddressFamily != tt.want {
+				t.Errorf("createSvcKey() family = %v, want %v", svc.AddressFamily, tt.want)
+			}
+			if len(svc.Address) != tt.len {
+				t.Errorf("createSvcKey() address length = %d, want %d", len(svc.Address), tt.len)
+			}
+			if svc.Netmask != tt.netmask {
+				t.Errorf("createSvcKey() netmask = %#x, want %#x", svc.Netmask, tt.netmask)
+			}
+		})
+	}
+}
+
+func TestCreateDestRejectsInvalidAddress(t *testing.T) {
+	if _, err := createDest("not-an-ip", 80, 0, 0); err == nil {
+		t.Error("createDest() expected an error for an invalid address")
+	}
+}
+
+func TestSetPersistence(t *testing.T) {
+	tests := []struct {
+		name        string
+		vip         string
+		timeout     uint32
+		netmask     uint8
+		wantFlags   uint32
+		wantNetmask uint32
+	}{
+		{"not persistent", "10.0.0.1", 0, 24, 0, 0xffffffff},
+		{"ipv4 host", "10.0.0.1", 300, 0, libipvs.IP_VS_SVC_F_PERSISTENT, 0xffffffff},
+		{"ipv4 network", "10.0.0.1", 300, 24, libipvs.IP_VS_SVC_F_PERSISTENT,
+			nativeEndian.Uint32([]byte{255, 255, 255, 0})},
+		{"ipv6 host", "fd11:bcb5:61df::1", 300, 0, libipvs.IP_VS_SVC_F_PERSISTENT, 128},
+		{"ipv6 network", "fd11:bcb5:61df::1", 300, 64, libipvs.IP_VS_SVC_F_PERSISTENT, 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := createSvcKey(tt.vip, "tcp", 80, 0)
+			if err != nil {
+				t.Fatalf("createSvcKey() error = %v", err)
+			}
+			setPersistence(svc, tt.timeout, tt.netmask)
+			if svc.Flags.Flags != tt.wantFlags {
+				t.Errorf("setPersistence() flags = %#x, want %#x", svc.Flags.Flags, tt.wantFlags)
+			}
+			if svc.Timeout != tt.timeout {
+				t.Errorf("setPersistence() timeout = %d, want %d", svc.Timeout, tt.timeout)
+			}
+			if svc.Netmask != tt.wantNetmask {
+				t.Errorf("setPersistence() netmask = %#x, want %#x", svc.Netmask, tt.wantNetmask)
+			}
+		})
+	}
+}
+
+func TestCreateSvcKeyWithFwmark(t *testing.T) {
+	svc, err := createSvcKey("fd11:bcb5:61df::1", "tcp", 80, 42)
+	if err != nil {
+		t.Fatalf("createSvcKey() error = %v", err)
+	}
+	if svc.FWMark != 42 {
+		t.Errorf("createSvcKey() fwmark = %d, want 42", svc.FWMark)
+	}
+	if svc.Address != nil || svc.Port != 0 || svc.Protocol != 0 {
+		t.Errorf("createSvcKey() fwmark service must not have an address, port or protocol: %+v", svc)
+	}
+	if svc.AddressFamily != syscall.AF_INET6 {
+		t.Errorf("createSvcKey() family = %v, want %v", svc.AddressFamily, syscall.AF_INET6)
+	}
+}
+
+func TestNewServiceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		vip  string
+		want Service
+	}{
+		{"ipv4", "10.0.0.1", Service{VIP: "10.0.0.1", Port: 80, Protocol: "tcp", Family: syscall.AF_INET,
+			Sched: "sh", Flags: []string{"sh-fallback", "sh-port"}, Timeout: 300, Netmask: 24}},
+		{"ipv6", "fd11:bcb5:61df::1", Service{VIP: "fd11:bcb5:61df::1", Port: 80, Protocol: "tcp",
+			Family: syscall.AF_INET6, Sched: "sh", Flags: []string{"sh-fallback", "sh-port"}, Timeout: 300,
+			Netmask: 64}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := createSvcKey(tt.vip, "tcp", 80, 0)
+			if err != nil {
+				t.Fatalf("createSvcKey() error = %v", err)
+			}
+			svc.SchedName = "sh"
+			svc.Flags.Flags = createFlagbits([]string{"sh-fallback", "sh-port"})
+			setPersistence(svc, tt.want.Timeout, tt.want.Netmask)
+			if got := newService(svc); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("newService() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameService(t *testing.T) {
+	key, _ := createSvcKey("10.0.0.1", "tcp", 80, 0)
+	same, _ := createSvcKey("10.0.0.1", "tcp", 80, 0)
+	other, _ := createSvcKey("10.0.0.1", "udp", 80, 0)
+	marked, _ := createSvcKey("10.0.0.1", "tcp", 80, 7)
+
+	if !sameService(same, key) {
+		t.Error("sameService() = false for identical services")
+	}
+	if sameService(other, key) {
+		t.Error("sameService() = true for services with different protocols")
+	}
+	if sameService(marked, key) {
+		t.Error("sameService() = true for a firewall mark service")
+	}
+}
+
+func TestFwdName(t *testing.T) {
+	for _, fwd := range []string{"nat", "dr", "tunnel"} {
+		if got := fwdName(libipvs.FwdMethod(backendForwarding[fwd])); got != fwd {
+			t.Errorf("fwdName() = %q, want %q", got, fwd)
+		}
+	}
+}
+
+func TestSameFlagsAndForwarding(t *testing.T) {
+	if !SameFlags([]string{"flag-2", "flag-1"}, []string{"sh-fallback", "sh-port"}) {
+		t.Error("SameFlags() = false for equivalent flags")
+	}
+	if SameFlags([]string{"flag-1"}, nil) {
+		t.Error("SameFlags() = true for different flags")
+	}
+	if !SameForwarding("ipip", "tunnel") || SameForwarding("nat", "dr") {
+		t.Error("SameForwarding() doesn't match forwarding methods")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/kobolog/gorb/core"
 	"github.com/kobolog/gorb/util"
@@ -41,13 +42,20 @@ var (
 	// Version get dynamically set to git rev by ldflags at build time
 	Version = "DEV"
 
-	debug        = flag.Bool("v", false, "enable verbose output")
-	device       = flag.String("i", "eth0", "default interface to bind services on")
-	flush        = flag.Bool("f", false, "flush IPVS pools on start")
-	listen       = flag.String("l", ":4672", "endpoint to listen for HTTP requests")
-	consul       = flag.String("c", "", "URL for Consul HTTP API")
-	vipInterface = flag.String("vipi", "", "interface to add VIPs")
-	storeURLs    = flag.String("store", "", "comma delimited list of store urls for sync data. All urls must have"+
+	debug         = flag.Bool("v", false, "enable verbose output")
+	device        = flag.String("i", "eth0", "default interface to bind services on")
+	flush         = flag.Bool("f", false, "flush IPVS pools on start")
+	adopt         = flag.Bool("adopt", false, "adopt existing IPVS services and backends on start")
+	driftInterval = flag.Duration("drift-interval", 0, "interval to check IPVS for changes made outside of GORB")
+	driftRepair   = flag.Bool("drift-repair", false, "revert changes made to IPVS outside of GORB")
+	passive       = flag.Duration("passive-interval", 0, "interval to check backend IPVS statistics for failures")
+	passiveRatio  = flag.Float64("passive-inactive-ratio", 0, "ratio of inactive TCP connections ejecting a backend")
+	passiveConns  = flag.Uint("passive-min-conns", 10, "minimum number of connections to eject a backend")
+	passiveEject  = flag.Duration("passive-ejection", 30*time.Second, "time to keep passively ejected backends down")
+	listen        = flag.String("l", ":4672", "endpoint to listen for HTTP requests")
+	consul        = flag.String("c", "", "URL for Consul HTTP API")
+	vipInterface  = flag.String("vipi", "", "interface to add VIPs")
+	storeURLs     = flag.String("store", "", "comma delimited list of store urls for sync data. All urls must have"+
 		" identical schemes and paths.")
 	storeTimeout     = flag.Int64("store-sync-time", 60, "sync-time for store")
 	storeServicePath = flag.String("store-service-path", "services", "store service path")
@@ -84,11 +92,20 @@ func main() {
 	}
 
 	ctx, err := core.NewContext(core.ContextOptions{
-		Disco:        *consul,
-		Endpoints:    hostIPs,
-		Flush:        *flush,
-		ListenPort:   listenPort,
-		VipInterface: *vipInterface})
+		Disco:         *consul,
+		Endpoints:     hostIPs,
+		Flush:         *flush,
+		Adopt:         *adopt,
+		ListenPort:    listenPort,
+		VipInterface:  *vipInterface,
+		DriftInterval: *driftInterval,
+		DriftRepair:   *driftRepair,
+		Passive: core.PassiveOptions{
+			Interval:      *passive,
+			InactiveRatio: *passiveRatio,
+			MinConns:      uint32(*passiveConns),
+			Ejection:      *passiveEject,
+		}})
 
 	if err != nil {
 		log.Fatalf("error while initializing server context: %s", err)
@@ -118,7 +135,12 @@ func main() {
 	r.Handle("/service/{vsID}/{rsID}", backendRemoveHandler{ctx}).Methods("DELETE")
 	r.Handle("/service", serviceListHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}", serviceStatusHandler{ctx}).Methods("GET")
+	// Registered before backends, so that it isn't taken for a backend status.
+	r.Handle("/service/{vsID}/connections", connectionListHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}/{rsID}", backendStatusHandler{ctx}).Methods("GET")
+	r.Handle("/service/{vsID}/{rsID}/connections", connectionListHandler{ctx}).Methods("GET")
+	r.Handle("/drift", driftHandler{ctx}).Methods("GET")
+	r.Handle("/pulse/drivers", pulseDriverListHandler{}).Methods("GET")
 	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	log.Infof("setting up HTTP server on %s", *listen)
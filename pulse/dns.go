@@ -0,0 +1,173 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	errMissingName = errors.New("dns pulse requires a name to query")
+	errUnknownType = errors.New("specified dns record type is unknown")
+)
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+type dnsPulse struct {
+	Driver
+	roundTrip
+
+	endpoint string
+	timeout  time.Duration
+	question dnsmessage.Question
+	answer   string
+}
+
+func newDNSDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	name := opts.Get("name", "").(string)
+	if len(name) == 0 {
+		return nil, errMissingName
+	} else if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	qtype, exists := dnsTypes[strings.ToUpper(opts.Get("type", "A").(string))]
+	if !exists {
+		return nil, errUnknownType
+	}
+
+	answer := opts.Get("answer", "").(string)
+	if qtype != dnsmessage.TypeTXT {
+		answer = normalizeAnswer(answer)
+	}
+
+	return &dnsPulse{
+		endpoint: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		timeout:  timeout,
+		question: dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		answer:   answer,
+	}, nil
+}
+
+func (p *dnsPulse) Check() StatusType {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{p.question},
+	}
+
+	payload, err := query.Pack()
+	if err != nil {
+		log.Errorf("unable to build dns query for %s: %s", p.endpoint, err)
+		return StatusDown
+	}
+
+	var response dnsmessage.Message
+
+	start := time.Now()
+
+	// Stray replies, e.g. to earlier timed out queries, are skipped.
+	_, err = exchange(p.endpoint, p.timeout, payload, func(reply []byte) bool {
+		return response.Unpack(reply) == nil && response.Response && response.ID == query.ID
+	})
+
+	p.since(start)
+
+	if err != nil {
+		log.Errorf("no dns reply from %s: %s", p.endpoint, err)
+		return StatusDown
+	} else if response.RCode != dnsmessage.RCodeSuccess {
+		log.Errorf("dns query for %s to %s failed: %s", p.question.Name, p.endpoint, response.RCode)
+		return StatusDown
+	} else if len(p.answer) != 0 && !p.answered(response.Answers) {
+		log.Errorf("dns reply from %s has no %s answer for %s", p.endpoint, p.answer, p.question.Name)
+		return StatusDown
+	}
+
+	return StatusUp
+}
+
+func (p *dnsPulse) answered(answers []dnsmessage.Resource) bool {
+	for _, r := range answers {
+		if r.Header.Type == p.question.Type && answerValue(r.Body) == p.answer {
+			return true
+		}
+	}
+	return false
+}
+
+// answerValue formats the resource data the same way as expected answers are given.
+func answerValue(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return normalizeAnswer(r.CNAME.String())
+	case *dnsmessage.MXResource:
+		return normalizeAnswer(r.MX.String())
+	case *dnsmessage.NSResource:
+		return normalizeAnswer(r.NS.String())
+	case *dnsmessage.PTRResource:
+		return normalizeAnswer(r.PTR.String())
+	case *dnsmessage.SOAResource:
+		return normalizeAnswer(r.NS.String())
+	case *dnsmessage.SRVResource:
+		return normalizeAnswer(r.Target.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(r.TXT, "")
+	}
+	return ""
+}
+
+// normalizeAnswer makes expected names and addresses comparable with answerValue,
+// TXT answers are compared as is.
+func normalizeAnswer(answer string) string {
+	if ip := net.ParseIP(answer); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(strings.TrimSuffix(answer, "."))
+}
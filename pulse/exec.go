@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	errMissingCommand = errors.New("exec pulse requires a command")
+	errInvalidArgs    = errors.New("exec pulse args must be a list of strings")
+	errExecTimeout    = errors.New("timed out while running the command")
+)
+
+// Only the beginning of the command output is kept in metrics.
+const maxOutput = 1024
+
+// Reporter is implemented by drivers which provide details of their last check,
+// e.g. command output, which are then included in backend metrics.
+type Reporter interface {
+	Output() string
+}
+
+type execPulse struct {
+	Driver
+
+	command string
+	args    []string
+	env     []string
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	output string
+}
+
+func newExecDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	command := opts.Get("command", "").(string)
+	if len(command) == 0 {
+		return nil, errMissingCommand
+	}
+
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+
+	if v, exists := opts["args"]; exists {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, errInvalidArgs
+		}
+
+		for _, arg := range list {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, errInvalidArgs
+			}
+			args = append(args, s)
+		}
+	}
+
+	return &execPulse{
+		command: path,
+		args:    args,
+		env:     append(os.Environ(), "GORB_HOST="+host, "GORB_PORT="+strconv.Itoa(int(port))),
+		timeout: timeout,
+	}, nil
+}
+
+func (p *execPulse) Check() StatusType {
+	output := &limitedBuffer{limit: maxOutput}
+
+	cmd := exec.Command(p.command, p.args...)
+	cmd.Env, cmd.Stdout, cmd.Stderr = p.env, output, output
+	cmd.SysProcAttr = execProcessAttr()
+
+	err := cmd.Start()
+
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+
+		select {
+		case err = <-done:
+		case <-timer.C:
+			// Background children keep the output open and block Wait as well,
+			// so the whole process group is killed.
+			killProcessGroup(cmd.Process)
+			<-done
+			err = errExecTimeout
+		}
+	}
+
+	p.mutex.Lock()
+	p.output = output.String()
+	p.mutex.Unlock()
+
+	if err != nil {
+		log.Errorf("health check command %s failed: %s", p.command, err)
+		return StatusDown
+	}
+
+	return StatusUp
+}
+
+func (p *execPulse) Output() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.output
+}
+
+// limitedBuffer keeps up to limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	limit     int
+	data      []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - len(b.data); n < len(p) {
+		b.data, b.truncated = append(b.data, p[:n]...), true
+	} else {
+		b.data = append(b.data, p...)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return string(b.data) + "..."
+	}
+	return string(b.data)
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type grpcPulse struct {
+	Driver
+	roundTrip
+
+	endpoint string
+	service  string
+	timeout  time.Duration
+	options  []grpc.DialOption
+}
+
+func newGRPCDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	p := &grpcPulse{
+		endpoint: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		service:  opts.Get("service", "").(string),
+		timeout:  timeout,
+		options:  []grpc.DialOption{grpc.WithBlock()},
+	}
+
+	if opts.Get("tls", false).(bool) {
+		cfg, err := newTLSConfig(host, opts)
+		if err != nil {
+			return nil, err
+		}
+		p.options = append(p.options, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else {
+		p.options = append(p.options, grpc.WithInsecure())
+	}
+
+	return p, nil
+}
+
+func (p *grpcPulse) Check() StatusType {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, p.endpoint, p.options...)
+	if err != nil {
+		log.Errorf("unable to connect to %s: %s", p.endpoint, err)
+		return StatusDown
+	}
+
+	defer conn.Close()
+
+	start := time.Now()
+
+	r, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: p.service})
+	p.since(start)
+
+	if err != nil {
+		log.Errorf("health check of %s failed: %s", p.endpoint, err)
+		return StatusDown
+	} else if r.Status != healthpb.HealthCheckResponse_SERVING {
+		log.Errorf("%s is %s", p.endpoint, r.Status)
+		return StatusDown
+	}
+
+	return StatusUp
+}
@@ -21,10 +21,18 @@
 package pulse
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kobolog/gorb/util"
@@ -33,19 +41,57 @@ import (
 )
 
 var (
-	errRedirects = errors.New("redirects are not supported for pulse requests")
+	errRedirects     = errors.New("redirects are not supported for pulse requests")
+	errInvalidCA     = errors.New("no certificates found in the CA bundle")
+	errInvalidExpect = errors.New("expect must be a status code, a class (e.g. 2xx) or a range (e.g. 200-299)")
+	errInvalidHeader = errors.New("headers must be an object with string values")
 )
 
+// Only the beginning of the response body is matched.
+const maxMatchedBody = 64 * 1024
+
 type httpPulse struct {
 	Driver
+	roundTrip
+
+	client  http.Client
+	method  string
+	url     string
+	host    string
+	headers http.Header
+	body    string
+
+	expect []statusRange
+	match  string
+	regex  *regexp.Regexp
+}
+
+// statusRange is an inclusive range of accepted status codes.
+type statusRange struct {
+	min, max int
+}
+
+func newGETDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	return newHTTPDriver("http", host, port, timeout, opts, nil)
+}
+
+func newHTTPSDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	cfg, err := newTLSConfig(host, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	client http.Client
-	httpRq *http.Request
-	expect int
+	return newHTTPDriver("https", host, port, timeout, opts, &http.Transport{TLSClientConfig: cfg})
 }
 
-func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
-	c := http.Client{Timeout: 5 * time.Second, CheckRedirect: func(
+func newHTTPDriver(
+	scheme, host string,
+	port uint16,
+	timeout time.Duration,
+	opts util.DynamicMap,
+	transport http.RoundTripper,
+) (Driver, error) {
+	c := http.Client{Timeout: timeout, Transport: transport, CheckRedirect: func(
 		req *http.Request,
 		via []*http.Request,
 	) error {
@@ -53,30 +99,223 @@ func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error
 	}}
 
 	u := url.URL{
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s:%d", host, port),
+		Scheme: scheme,
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
 		Path:   opts.Get("path", "/").(string)}
 
-	r, err := http.NewRequest(opts.Get("method", "GET").(string), u.String(), nil)
+	p := &httpPulse{
+		client: c,
+		method: opts.Get("method", "GET").(string),
+		url:    u.String(),
+		host:   opts.Get("host", "").(string),
+		body:   opts.Get("body", "").(string),
+		match:  opts.Get("match", "").(string),
+	}
+
+	var err error
+
+	if p.expect, err = parseExpect(opts["expect"]); err != nil {
+		return nil, err
+	}
+
+	if p.headers, err = parseHeaders(opts["headers"]); err != nil {
+		return nil, err
+	}
+
+	if pattern := opts.Get("regex", "").(string); len(pattern) != 0 {
+		if p.regex, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate the request once, it's rebuilt for every check as the body is consumed.
+	if _, err := p.newRequest(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// parseExpect parses accepted status codes, e.g. 200, "2xx", "200-299" or a comma
+// separated list of those.
+func parseExpect(v interface{}) ([]statusRange, error) {
+	switch v := v.(type) {
+	case nil:
+		return []statusRange{{200, 200}}, nil
+	case int:
+		return []statusRange{{v, v}}, nil
+	case float64:
+		// JSON numbers are decoded as floats.
+		return []statusRange{{int(v), int(v)}}, nil
+	case string:
+		var result []statusRange
+
+		for _, spec := range strings.Split(v, ",") {
+			r, err := parseStatusRange(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, r)
+		}
+
+		return result, nil
+	}
+
+	return nil, errInvalidExpect
+}
+
+func parseStatusRange(spec string) (statusRange, error) {
+	if len(spec) == 3 && strings.HasSuffix(strings.ToLower(spec), "xx") {
+		if class, err := strconv.Atoi(spec[:1]); err == nil && class > 0 {
+			return statusRange{class * 100, class*100 + 99}, nil
+		}
+	} else if bounds := strings.SplitN(spec, "-", 2); len(bounds) == 2 {
+		min, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		max, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err1 == nil && err2 == nil && min <= max {
+			return statusRange{min, max}, nil
+		}
+	} else if code, err := strconv.Atoi(spec); err == nil {
+		return statusRange{code, code}, nil
+	}
+
+	return statusRange{}, errInvalidExpect
+}
+
+func parseHeaders(v interface{}) (http.Header, error) {
+	result := make(http.Header)
+
+	if v == nil {
+		return result, nil
+	}
+
+	headers, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidHeader
+	}
+
+	for k, v := range headers {
+		value, ok := v.(string)
+		if !ok {
+			return nil, errInvalidHeader
+		}
+		result.Set(k, value)
+	}
+
+	return result, nil
+}
+
+// newTLSConfig configures the TLS client of the https and grpc drivers. The server name
+// used for SNI and verification defaults to the backend host.
+func newTLSConfig(host string, opts util.DynamicMap) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         opts.Get("sni", host).(string),
+		InsecureSkipVerify: opts.Get("insecure", false).(bool),
+	}
+
+	if path := opts.Get("ca", "").(string); len(path) != 0 {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errInvalidCA
+		}
+	}
+
+	cert, key := opts.Get("cert", "").(string), opts.Get("key", "").(string)
+
+	if len(cert) != 0 || len(key) != 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return cfg, nil
+}
+
+func (p *httpPulse) newRequest() (*http.Request, error) {
+	var body io.Reader
+	if len(p.body) != 0 {
+		body = strings.NewReader(p.body)
+	}
+
+	r, err := http.NewRequest(p.method, p.url, body)
 	if err != nil {
 		return nil, err
 	}
 
-	return &httpPulse{
-		client: c,
-		httpRq: r,
-		expect: opts.Get("expect", 200).(int),
-	}, nil
+	for k, v := range p.headers {
+		r.Header[k] = v
+	}
+
+	if len(p.host) != 0 {
+		r.Host = p.host
+	}
+
+	return r, nil
+}
+
+func (p *httpPulse) expected(code int) bool {
+	for _, r := range p.expect {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the response status and body.
+func (p *httpPulse) verify(r *http.Response) error {
+	if !p.expected(r.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", r.StatusCode)
+	}
+
+	if len(p.match) == 0 && p.regex == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMatchedBody))
+	if err != nil {
+		return err
+	}
+
+	if len(p.match) != 0 && !strings.Contains(string(body), p.match) {
+		return fmt.Errorf("response doesn't contain %q", p.match)
+	} else if p.regex != nil && !p.regex.Match(body) {
+		return fmt.Errorf("response doesn't match %q", p.regex)
+	}
+
+	return nil
 }
 
 func (p *httpPulse) Check() StatusType {
-	if r, err := p.client.Do(p.httpRq); err != nil {
-		log.Errorf("error while communicating with %s: %s", p.httpRq.URL, err)
-	} else if r.StatusCode != p.expect {
-		log.Errorf("received non-%d status code from %s", p.expect, p.httpRq.URL)
-	} else {
-		return StatusUp
+	rq, err := p.newRequest()
+	if err != nil {
+		log.Errorf("error while creating request for %s: %s", p.url, err)
+		return StatusDown
+	}
+
+	start := time.Now()
+
+	r, err := p.client.Do(rq)
+	if err != nil {
+		log.Errorf("error while communicating with %s: %s", p.url, err)
+		return StatusDown
+	}
+
+	p.since(start)
+
+	defer r.Body.Close()
+
+	if err := p.verify(r); err != nil {
+		log.Errorf("health check of %s failed: %s", p.url, err)
+		return StatusDown
 	}
 
-	return StatusDown
+	return StatusUp
 }
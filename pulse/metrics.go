@@ -21,46 +21,157 @@
 package pulse
 
 import (
+	"sort"
 	"time"
 )
 
+// Health is tracked in buckets of a minute over the longest window.
+const (
+	healthBucket    = time.Minute
+	healthShortTerm = 5
+	healthLongTerm  = 60
+)
+
+// Latency percentiles are calculated over the last successful checks.
+const latencySamples = 100
+
 // Metrics contain statistical information about backend's Pulse.
 type Metrics struct {
-	Status StatusType    `json:"status"`
-	Health float64       `json:"health"`
-	Uptime time.Duration `json:"uptime"`
+	Status StatusType `json:"status"`
+
+	// Durations are reported in seconds through the API, uptime in whole seconds
+	// as it always was.
+	Uptime        time.Duration `json:"-"`
+	UptimeSeconds int64         `json:"uptime"`
+
+	// Shares of checks with the backend up over the last 5 minutes and the last
+	// hour, 1 if there were no checks yet.
+	Health   float64 `json:"health"`
+	Health1h float64 `json:"health_1h"`
+
+	// Time of the last status change, the number of consecutive failed checks
+	// (even if the status hasn't changed yet) and the latency of the last check, as
+	// reported by the driver if it's a Timer.
+	LastTransition      time.Time     `json:"last_transition"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	Latency             time.Duration `json:"-"`
+	LatencySeconds      float64       `json:"latency_seconds"`
+
+	// Latency percentiles of the last 100 successful checks.
+	LatencyP50        time.Duration `json:"-"`
+	LatencyP90        time.Duration `json:"-"`
+	LatencyP99        time.Duration `json:"-"`
+	LatencyP50Seconds float64       `json:"latency_p50_seconds"`
+	LatencyP90Seconds float64       `json:"latency_p90_seconds"`
+	LatencyP99Seconds float64       `json:"latency_p99_seconds"`
+
+	// Details of the last check, if provided by the driver.
+	Output string `json:"output,omitempty"`
 
 	// Historical information for statistics calculation.
-	lastTs time.Time
-	record []StatusType
+	lastTs    time.Time
+	buckets   [healthLongTerm]healthBucketCounts
+	latencies [latencySamples]time.Duration
+	samples   int
+}
+
+type healthBucketCounts struct {
+	start     time.Time
+	up, total int
 }
 
 // NewMetrics creates a new instance of metrics.
 func NewMetrics() *Metrics {
-	return &Metrics{Status: StatusUp, Health: 1, Uptime: 0, lastTs: time.Now()}
+	now := time.Now()
+	return &Metrics{Status: StatusUp, Health: 1, Health1h: 1, LastTransition: now, lastTs: now}
 }
 
 // Update updates metrics based on Pulse status message.
 func (m *Metrics) Update(status StatusType) Metrics {
-	m.Status = status
-	m.Health = 0
-	m.record = append(m.record, status)
+	ts := time.Now()
 
-	if len(m.record) > 100 {
-		m.record = m.record[1:]
+	if status != m.Status {
+		m.LastTransition = ts
 	}
 
-	for _, result := range m.record {
-		m.Health += float64(result)
+	m.Status = status
+
+	if status == StatusUp || status == StatusDown {
+		m.record(ts, status == StatusUp)
 	}
 
-	m.Health = 1.0 - m.Health/float64(len(m.record))
+	m.Health = m.health(ts, healthShortTerm)
+	m.Health1h = m.health(ts, healthLongTerm)
 
-	if ts := time.Now(); m.Status != StatusUp {
-		m.Uptime, m.lastTs = 0, ts
+	if m.Status != StatusUp {
+		m.Uptime = 0
 	} else {
-		m.Uptime, m.lastTs = m.Uptime+ts.Sub(m.lastTs)/time.Second, ts
+		m.Uptime += ts.Sub(m.lastTs)
 	}
 
+	m.UptimeSeconds = int64(m.Uptime / time.Second)
+	m.LatencySeconds = m.Latency.Seconds()
+	m.LatencyP50Seconds = m.LatencyP50.Seconds()
+	m.LatencyP90Seconds = m.LatencyP90.Seconds()
+	m.LatencyP99Seconds = m.LatencyP99.Seconds()
+
+	m.lastTs = ts
+
 	return *m
 }
+
+// record adds a status to the bucket of its minute, reusing expired buckets.
+func (m *Metrics) record(ts time.Time, up bool) {
+	start := ts.Truncate(healthBucket)
+	b := &m.buckets[start.Unix()/int64(healthBucket/time.Second)%healthLongTerm]
+
+	if !b.start.Equal(start) {
+		*b = healthBucketCounts{start: start}
+	}
+
+	if b.total++; up {
+		b.up++
+	}
+}
+
+// health returns the share of up statuses over the last n buckets.
+func (m *Metrics) health(ts time.Time, n int) float64 {
+	var (
+		up, total int
+		since     = ts.Truncate(healthBucket).Add(-time.Duration(n-1) * healthBucket)
+	)
+
+	for _, b := range m.buckets {
+		if !b.start.Before(since) && !b.start.After(ts) {
+			up, total = up+b.up, total+b.total
+		}
+	}
+
+	if total == 0 {
+		return 1
+	}
+
+	return float64(up) / float64(total)
+}
+
+// recordLatency adds the latency of a successful check and updates percentiles.
+func (m *Metrics) recordLatency(latency time.Duration) {
+	m.latencies[m.samples%latencySamples] = latency
+	m.samples++
+
+	n := m.samples
+	if n > latencySamples {
+		n = latencySamples
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, m.latencies[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// Nearest rank.
+	percentile := func(p int) time.Duration {
+		return sorted[(n*p+99)/100-1]
+	}
+
+	m.LatencyP50, m.LatencyP90, m.LatencyP99 = percentile(50), percentile(90), percentile(99)
+}
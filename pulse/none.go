@@ -21,6 +21,8 @@
 package pulse
 
 import (
+	"time"
+
 	"github.com/kobolog/gorb/util"
 )
 
@@ -28,7 +30,7 @@ type constantDriver struct {
 	status StatusType
 }
 
-func newNoopDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
+func newNoopDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
 	return &constantDriver{StatusUp}, nil
 }
 
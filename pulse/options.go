@@ -32,15 +32,38 @@ import (
 var (
 	ErrUnknownPulseType     = errors.New("specified pulse type is unknown")
 	ErrInvalidPulseInterval = errors.New("pulse interval must be positive")
+	ErrInvalidThreshold     = errors.New("pulse rise and fall thresholds must not be negative")
+	ErrInvalidMaxBackoff    = errors.New("pulse max back-off must not be shorter than the fast interval")
+	ErrInvalidPulseTimeout  = errors.New("pulse timeout must be positive and shorter than the interval")
 )
 
+// Checks time out after 5 seconds by default, or half of the interval if it's shorter.
+const defaultTimeout = 5 * time.Second
+
 // Options contain Pulse configuration.
 type Options struct {
 	Type     string          `json:"type"`
 	Interval string          `json:"interval"`
 	Args     util.DynamicMap `json:"args"`
 
-	interval time.Duration
+	// Number of consecutive successful (or failed) checks required to change
+	// the backend status, 1 by default.
+	Rise int `json:"rise"`
+	Fall int `json:"fall"`
+
+	// Interval between checks while the status is changing or the backend is down,
+	// the regular interval by default. If MaxBackoff is set, the interval doubles
+	// after every failed check of a down backend, up to MaxBackoff.
+	FastInterval string `json:"fast_interval"`
+	MaxBackoff   string `json:"max_backoff"`
+
+	// Timeout of a single check, must be shorter than both intervals.
+	Timeout string `json:"timeout"`
+
+	interval     time.Duration
+	fastInterval time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
 }
 
 // Validate fills missing fields and validates Pulse configuration.
@@ -56,7 +79,7 @@ func (o *Options) Validate() error {
 
 	o.Type = strings.ToLower(o.Type)
 
-	if fn := get[o.Type]; fn == nil {
+	if fn := lookupDriver(o.Type); fn == nil {
 		return ErrUnknownPulseType
 	}
 
@@ -68,5 +91,52 @@ func (o *Options) Validate() error {
 		return ErrInvalidPulseInterval
 	}
 
+	if o.Rise < 0 || o.Fall < 0 {
+		return ErrInvalidThreshold
+	}
+
+	if o.Rise == 0 {
+		o.Rise = 1
+	}
+
+	if o.Fall == 0 {
+		o.Fall = 1
+	}
+
+	o.fastInterval = o.interval
+
+	if len(o.FastInterval) != 0 {
+		if o.fastInterval, err = util.ParseInterval(o.FastInterval); err != nil {
+			return err
+		} else if o.fastInterval <= 0 {
+			return ErrInvalidPulseInterval
+		}
+	}
+
+	o.maxBackoff = 0
+
+	if len(o.MaxBackoff) != 0 {
+		if o.maxBackoff, err = util.ParseInterval(o.MaxBackoff); err != nil {
+			return err
+		} else if o.maxBackoff < o.fastInterval {
+			return ErrInvalidMaxBackoff
+		}
+	}
+
+	shortest := o.interval
+	if o.fastInterval < shortest {
+		shortest = o.fastInterval
+	}
+
+	if len(o.Timeout) == 0 {
+		if o.timeout = defaultTimeout; o.timeout >= shortest {
+			o.timeout = shortest / 2
+		}
+	} else if o.timeout, err = util.ParseInterval(o.Timeout); err != nil {
+		return err
+	} else if o.timeout <= 0 || o.timeout >= shortest {
+		return ErrInvalidPulseTimeout
+	}
+
 	return nil
 }
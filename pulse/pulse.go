@@ -22,6 +22,9 @@ package pulse
 
 import (
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kobolog/gorb/util"
@@ -29,28 +32,116 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
-// Driver provides the actual health check for Pulse.
+// Driver provides the actual health check for Pulse. Check is never called
+// concurrently for the same Driver, and must return within the pulse timeout.
 type Driver interface {
 	Check() StatusType
 }
 
+// Timer is implemented by drivers which measure the round-trip latency of their
+// last successful check themselves, e.g. without building requests or resolving
+// names. Otherwise, the latency is the duration of the whole check. Zero means
+// that the check had no round trip to measure, and it isn't recorded.
+type Timer interface {
+	Latency() time.Duration
+}
+
+// roundTrip implements Timer for drivers embedding it.
+type roundTrip struct {
+	latency time.Duration
+}
+
+func (r *roundTrip) Latency() time.Duration {
+	return r.latency
+}
+
+// since records the latency of a round trip which started at the given time.
+func (r *roundTrip) since(start time.Time) {
+	r.latency = time.Since(start)
+}
+
+// Factory creates a Driver checking the backend at host and port, using the pulse
+// timeout and driver specific args from Options.
+type Factory func(host string, port uint16, timeout time.Duration, args util.DynamicMap) (Driver, error)
+
 var (
-	get = map[string]func(string, uint16, util.DynamicMap) (Driver, error){
-		"tcp":  newTCPDriver,
-		"http": newGETDriver,
-		"none": newNoopDriver,
-	}
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
 
 	// Use a separate random device to avoid fucking with other packages.
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
+func init() {
+	Register("tcp", newTCPDriver)
+	Register("sctp", newSCTPDriver)
+	Register("udp", newUDPDriver)
+	Register("dns", newDNSDriver)
+	Register("http", newGETDriver)
+	Register("https", newHTTPSDriver)
+	Register("grpc", newGRPCDriver)
+	Register("exec", newExecDriver)
+	Register("none", newNoopDriver)
+}
+
+// Register makes a driver available as the pulse type with the provided name,
+// which is case insensitive. It panics if the factory is nil or if the name is
+// already registered.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	name = strings.ToLower(name)
+
+	if factory == nil {
+		panic("pulse: Register factory is nil")
+	} else if _, exists := drivers[name]; exists {
+		panic("pulse: Register called twice for driver " + name)
+	}
+
+	drivers[name] = factory
+}
+
+// Drivers returns a sorted list of the registered pulse types.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	result := make([]string, 0, len(drivers))
+	for name := range drivers {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func lookupDriver(name string) Factory {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	return drivers[name]
+}
+
 // Pulse is an health check manager for a backend.
 type Pulse struct {
 	driver   Driver
 	interval time.Duration
 	stopCh   chan struct{}
 	metrics  *Metrics
+
+	// Thresholds and back-off, see Options.
+	rise, fall   int
+	fastInterval time.Duration
+	maxBackoff   time.Duration
+
+	// Current status, the number of consecutive checks disagreeing with it and
+	// the current back-off interval.
+	status  StatusType
+	streak  int
+	backoff time.Duration
+
+	// Set if the Pulse is stopped without notifying the Context.
+	silent bool
 }
 
 // New creates a new Pulse from the provided endpoint and options.
@@ -59,14 +150,24 @@ func New(host string, port uint16, opts *Options) (*Pulse, error) {
 		return nil, err
 	}
 
-	d, err := get[opts.Type](host, port, opts.Args)
+	d, err := lookupDriver(opts.Type)(host, port, opts.timeout, opts.Args)
 	if err != nil {
 		return nil, err
 	}
 
 	stopCh := make(chan struct{})
 
-	return &Pulse{d, opts.interval, stopCh, NewMetrics()}, nil
+	return &Pulse{
+		driver:       d,
+		interval:     opts.interval,
+		stopCh:       stopCh,
+		metrics:      NewMetrics(),
+		rise:         opts.Rise,
+		fall:         opts.Fall,
+		fastInterval: opts.fastInterval,
+		maxBackoff:   opts.maxBackoff,
+		status:       StatusUp,
+	}, nil
 }
 
 // Update is a Pulse notification message.
@@ -87,24 +188,98 @@ func (p *Pulse) Loop(id ID, pulseCh chan Update, consumerStopCh <-chan struct{})
 		case <-time.After(interval):
 			select {
 			// Recalculate metrics and statistics and send them to Context.
-			case pulseCh <- Update{id, p.metrics.Update(p.driver.Check())}:
+			case pulseCh <- Update{id, p.metrics.Update(p.check())}:
 			case <-consumerStopCh:
 				// prevent blocking if the consumer stops before us
 			}
 		case <-p.stopCh:
 			log.Infof("stopping pulse for %s", id)
-			pulseCh <- Update{id, p.metrics.Update(StatusRemoved)}
+			if !p.silent {
+				select {
+				case pulseCh <- Update{id, p.metrics.Update(StatusRemoved)}:
+				case <-consumerStopCh:
+					// nobody is left to be notified, e.g. the Context is closed
+				}
+			}
 			return
 		}
 
-		// TODO(@kobolog): Add exponential back-offs, thresholds.
-		interval = p.interval
+		interval = p.nextInterval()
 
 		log.Debugf("current pulse for %s: %s", id, p.metrics.Status.String())
 	}
 }
 
+// check runs the health check, the status only changes after enough consecutive
+// checks disagreeing with it.
+func (p *Pulse) check() StatusType {
+	start := time.Now()
+	result := p.driver.Check()
+	p.metrics.Latency = time.Since(start)
+
+	if t, ok := p.driver.(Timer); ok && result == StatusUp {
+		p.metrics.Latency = t.Latency()
+	}
+
+	if result == StatusUp {
+		p.metrics.ConsecutiveFailures = 0
+		if p.metrics.Latency > 0 {
+			p.metrics.recordLatency(p.metrics.Latency)
+		}
+	} else {
+		p.metrics.ConsecutiveFailures++
+	}
+
+	if r, ok := p.driver.(Reporter); ok {
+		p.metrics.Output = r.Output()
+	}
+
+	if result == p.status {
+		p.streak = 0
+		return p.status
+	}
+
+	threshold := p.fall
+	if result == StatusUp {
+		threshold = p.rise
+	}
+
+	if p.streak++; p.streak >= threshold {
+		p.status, p.streak = result, 0
+	}
+
+	return p.status
+}
+
+// nextInterval returns the interval until the next check.
+func (p *Pulse) nextInterval() time.Duration {
+	if p.status == StatusUp && p.streak == 0 {
+		p.backoff = 0
+		return p.interval
+	}
+
+	if p.status == StatusDown && p.streak == 0 && p.maxBackoff > 0 {
+		// The backend is still down, back off exponentially.
+		if p.backoff == 0 {
+			p.backoff = p.fastInterval
+		} else if p.backoff *= 2; p.backoff > p.maxBackoff {
+			p.backoff = p.maxBackoff
+		}
+		return p.backoff
+	}
+
+	p.backoff = 0
+	return p.fastInterval
+}
+
 // Stop stops the Pulse.
 func (p *Pulse) Stop() {
 	close(p.stopCh)
 }
+
+// StopSilently stops the Pulse without a removal notification, e.g. when it's
+// replaced with another Pulse for the same backend.
+func (p *Pulse) StopSilently() {
+	p.silent = true
+	close(p.stopCh)
+}
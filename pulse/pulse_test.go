@@ -21,15 +21,24 @@
 package pulse
 
 import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/kobolog/gorb/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func TestGenericOptions(t *testing.T) {
@@ -97,18 +106,62 @@ func TestGenericOptions(t *testing.T) {
 
 func TestMetrics(t *testing.T) {
 	m := NewMetrics()
+	created := m.LastTransition
 
-	// Record rollover.
-	for i := 0; i <= 100; i++ {
+	for i := 0; i < 3; i++ {
 		m.Update(StatusUp)
 	}
 
-	assert.Equal(t, 100, len(m.record))
+	assert.Equal(t, 1.0, m.Health)
+	assert.Equal(t, created, m.LastTransition)
+	assert.True(t, m.Uptime > 0)
 
 	// Uptime switch.
 	m.Update(StatusDown)
 
 	assert.Equal(t, time.Duration(0), m.Uptime)
+	assert.Equal(t, 0.75, m.Health)
+	assert.True(t, m.LastTransition.After(created))
+}
+
+func TestMetricsDurationsAreSerializedInSeconds(t *testing.T) {
+	m := NewMetrics()
+	m.lastTs = m.lastTs.Add(-90 * time.Second)
+	m.Latency = 20 * time.Millisecond
+	m.recordLatency(m.Latency)
+	m.Update(StatusUp)
+
+	b, err := json.Marshal(m)
+	assert.NoError(t, err)
+
+	var fields map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &fields))
+	assert.Equal(t, 90.0, fields["uptime"])
+	assert.Equal(t, 0.02, fields["latency_seconds"])
+	assert.Equal(t, 0.02, fields["latency_p50_seconds"])
+	assert.Equal(t, 0.02, fields["latency_p99_seconds"])
+	assert.NotContains(t, fields, "latency")
+}
+
+func TestMetricsWindows(t *testing.T) {
+	m := NewMetrics()
+	now := time.Now()
+
+	// Down an hour ago (out of the window), down half of the time 10 minutes ago,
+	// and up since then.
+	m.record(now.Add(-time.Hour), false)
+	m.record(now.Add(-10*time.Minute), false)
+	m.record(now.Add(-10*time.Minute), true)
+	m.record(now.Add(-time.Minute), true)
+	m.record(now, true)
+
+	assert.Equal(t, 1.0, m.health(now, healthShortTerm))
+	assert.Equal(t, 0.75, m.health(now, healthLongTerm))
+
+	// Expired buckets are reused.
+	m.record(now.Add(time.Hour), false)
+	assert.Equal(t, 0.0, m.health(now.Add(time.Hour), healthLongTerm))
+	assert.Equal(t, 1.0, NewMetrics().health(now, healthLongTerm))
 }
 
 func TestPulseChannel(t *testing.T) {
@@ -135,8 +188,8 @@ func TestPulseChannel(t *testing.T) {
 	assert.Equal(t, StatusUp, update.Metrics.Status)
 	assert.Equal(t, 1.0, update.Metrics.Health)
 
-	// TODO(@kobolog): Make it some reasonable value.
-	assert.Zero(t, update.Metrics.Uptime)
+	assert.True(t, update.Metrics.Uptime > 0)
+	assert.Zero(t, update.Metrics.ConsecutiveFailures)
 }
 
 func TestPulseStop(t *testing.T) {
@@ -168,6 +221,29 @@ func TestPulseStop(t *testing.T) {
 	assert.Equal(t, StatusRemoved, update.Metrics.Status)
 }
 
+func TestPulseStopAfterConsumer(t *testing.T) {
+	consumerStopCh := make(chan struct{})
+	done := make(chan struct{})
+
+	bp, err := New("", 0, &Options{Type: "none", Interval: "1m"})
+	require.NoError(t, err)
+
+	go func() {
+		bp.Loop(ID{"VsID", "rsID"}, make(chan Update), consumerStopCh)
+		close(done)
+	}()
+
+	// Nobody reads the removal notification once the consumer is gone.
+	close(consumerStopCh)
+	bp.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pulse is blocked on the removal notification")
+	}
+}
+
 func TestNopDriver(t *testing.T) {
 	bp, err := New("", 0, &Options{Type: "none"})
 	require.NoError(t, err)
@@ -259,3 +335,588 @@ func TestGETDriverNoConnection(t *testing.T) {
 	// Connection failure.
 	assert.Equal(t, StatusDown, bp.driver.Check())
 }
+
+func TestSCTPDriverNoAssociation(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	// Nothing is listening for SCTP on this port (and the kernel might not support SCTP at all).
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "sctp"})
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusDown, bp.driver.Check())
+}
+
+func TestThresholdOptions(t *testing.T) {
+	opts := &Options{Interval: "10s"}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, 1, opts.Rise)
+	assert.Equal(t, 1, opts.Fall)
+	assert.Equal(t, 10*time.Second, opts.fastInterval)
+	assert.Zero(t, opts.maxBackoff)
+
+	opts = &Options{Interval: "10s", Rise: 2, Fall: 3, FastInterval: "1s", MaxBackoff: "1m"}
+	require.NoError(t, opts.Validate())
+
+	assert.Equal(t, time.Second, opts.fastInterval)
+	assert.Equal(t, time.Minute, opts.maxBackoff)
+
+	assert.Equal(t, ErrInvalidThreshold, (&Options{Fall: -1}).Validate())
+	assert.Equal(t, ErrInvalidPulseInterval, (&Options{FastInterval: "-1s"}).Validate())
+	assert.Equal(t, ErrInvalidMaxBackoff, (&Options{FastInterval: "10s", MaxBackoff: "5s"}).Validate())
+}
+
+type fakeDriver struct {
+	results []StatusType
+}
+
+func (d *fakeDriver) Check() StatusType {
+	result := d.results[0]
+	d.results = d.results[1:]
+	return result
+}
+
+func TestThresholdsAndBackoff(t *testing.T) {
+	bp, err := New("", 0, &Options{Type: "none", Interval: "10s", Rise: 2, Fall: 3,
+		FastInterval: "1s", MaxBackoff: "3s"})
+	require.NoError(t, err)
+
+	down, up := StatusDown, StatusUp
+	bp.driver = &fakeDriver{[]StatusType{down, down, up, down, down, down, down, down, up, up}}
+
+	tests := []struct {
+		status   StatusType
+		interval time.Duration
+		failures int
+	}{
+		{up, time.Second, 1},
+		{up, time.Second, 2},
+		// A single success resets the failure streak.
+		{up, 10 * time.Second, 0},
+		{up, time.Second, 1},
+		{up, time.Second, 2},
+		{down, time.Second, 3},
+		{down, 2 * time.Second, 4},
+		{down, 3 * time.Second, 5},
+		{down, time.Second, 0},
+		{up, 10 * time.Second, 0},
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.status, bp.check(), "check %d", i)
+		assert.Equal(t, test.interval, bp.nextInterval(), "interval %d", i)
+		assert.Equal(t, test.failures, bp.metrics.ConsecutiveFailures, "failures %d", i)
+	}
+}
+
+func TestHTTPSDriver(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ca, err := ioutil.TempFile("", "gorb-ca")
+	require.NoError(t, err)
+	defer os.Remove(ca.Name())
+
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: ts.TLS.Certificates[0].Certificate[0]})
+	ca.Close()
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		args util.DynamicMap
+		rv   StatusType
+	}{
+		// Unknown certificate authority.
+		{util.DynamicMap{}, StatusDown},
+		{util.DynamicMap{"insecure": true}, StatusUp},
+		{util.DynamicMap{"ca": ca.Name()}, StatusUp},
+		{util.DynamicMap{"ca": ca.Name(), "sni": "example.com"}, StatusUp},
+		// Server name mismatch.
+		{util.DynamicMap{"ca": ca.Name(), "sni": "example.org"}, StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", uint16(tcpAddr.Port), &Options{Type: "https", Args: test.args})
+		require.NoError(t, err)
+
+		assert.Equal(t, test.rv, bp.driver.Check(), "args %v", test.args)
+	}
+
+	// Invalid CA bundle and missing client key.
+	_, err = New("127.0.0.1", 443, &Options{Type: "https", Args: util.DynamicMap{"ca": os.DevNull}})
+	assert.Equal(t, errInvalidCA, err)
+	_, err = New("127.0.0.1", 443, &Options{Type: "https", Args: util.DynamicMap{"cert": ca.Name()}})
+	assert.Error(t, err)
+}
+
+func TestHTTPDriverMatching(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Host != "example.com" || r.Header.Get("X-Check") != "gorb" || string(body) != "ping" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "ok", "version": 42}`))
+	}))
+	defer ts.Close()
+
+	request := util.DynamicMap{
+		"method":  "POST",
+		"host":    "example.com",
+		"headers": map[string]interface{}{"X-Check": "gorb"},
+		"body":    "ping",
+	}
+
+	tests := []struct {
+		args util.DynamicMap
+		rv   StatusType
+	}{
+		{util.DynamicMap{"expect": "2xx"}, StatusDown},
+		{util.DynamicMap{"expect": 202.0}, StatusUp},
+		{util.DynamicMap{"expect": "2xx"}, StatusUp},
+		{util.DynamicMap{"expect": "200-204"}, StatusUp},
+		{util.DynamicMap{"expect": "200, 3xx"}, StatusDown},
+		{util.DynamicMap{"expect": "2xx", "match": `"status": "ok"`}, StatusUp},
+		{util.DynamicMap{"expect": "2xx", "match": "fail"}, StatusDown},
+		{util.DynamicMap{"expect": "2xx", "regex": `"version": \d+`}, StatusUp},
+		{util.DynamicMap{"expect": "2xx", "regex": `"version": "\d+"`}, StatusDown},
+	}
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+
+	for i, test := range tests {
+		args := test.args
+		if i > 0 {
+			// Only the first check doesn't send the expected request.
+			for k, v := range request {
+				args[k] = v
+			}
+		}
+
+		bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "http", Args: args})
+		require.NoError(t, err)
+
+		// The request is sent again with the same body.
+		assert.Equal(t, test.rv, bp.driver.Check(), "args %v", args)
+		assert.Equal(t, test.rv, bp.driver.Check(), "args %v", args)
+	}
+
+	for _, args := range []util.DynamicMap{
+		{"expect": "20x"},
+		{"expect": "299-200"},
+		{"expect": true},
+		{"headers": map[string]interface{}{"X-Check": 1}},
+		{"regex": "("},
+	} {
+		_, err := New("localhost", 80, &Options{Type: "http", Args: args})
+		assert.Error(t, err, "args %v", args)
+	}
+}
+
+func TestTimeoutOptions(t *testing.T) {
+	tests := []struct {
+		in *Options
+		rv time.Duration
+	}{
+		{&Options{}, 5 * time.Second},
+		{&Options{Interval: "4s"}, 2 * time.Second},
+		{&Options{Interval: "1m", FastInterval: "2s"}, time.Second},
+		{&Options{Interval: "10s", Timeout: "500ms"}, 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		require.NoError(t, test.in.Validate())
+		assert.Equal(t, test.rv, test.in.timeout)
+	}
+
+	for _, opts := range []*Options{
+		{Interval: "5s", Timeout: "5s"},
+		{Interval: "1m", FastInterval: "1s", Timeout: "2s"},
+		{Timeout: "-1s"},
+	} {
+		assert.Equal(t, ErrInvalidPulseTimeout, opts.Validate())
+	}
+}
+
+func TestHTTPDriverTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+
+	bp, err := New("localhost", uint16(tcpAddr.Port), &Options{Type: "http", Timeout: "50ms"})
+	require.NoError(t, err)
+	assert.Equal(t, StatusDown, bp.driver.Check())
+
+	bp, err = New("localhost", uint16(tcpAddr.Port), &Options{Type: "http", Timeout: "1s"})
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check())
+}
+
+func TestExecDriver(t *testing.T) {
+	_, err := New("localhost", 80, &Options{Type: "exec"})
+	assert.Equal(t, errMissingCommand, err)
+
+	_, err = New("localhost", 80, &Options{Type: "exec", Args: util.DynamicMap{
+		"command": "sh", "args": []interface{}{1}}})
+	assert.Equal(t, errInvalidArgs, err)
+
+	_, err = New("localhost", 80, &Options{Type: "exec", Args: util.DynamicMap{
+		"command": "/nonexistent/check"}})
+	assert.Error(t, err)
+
+	tests := []struct {
+		script  string
+		status  StatusType
+		output  string
+		timeout string
+	}{
+		{script: `echo "$GORB_HOST:$GORB_PORT"`, status: StatusUp, output: "localhost:8080\n"},
+		{script: "echo failed >&2; exit 1", status: StatusDown, output: "failed\n"},
+		{script: "sleep 1", status: StatusDown, timeout: "50ms"},
+	}
+
+	for _, test := range tests {
+		bp, err := New("localhost", 8080, &Options{Type: "exec", Timeout: test.timeout, Args: util.DynamicMap{
+			"command": "sh", "args": []interface{}{"-c", test.script}}})
+		require.NoError(t, err)
+		assert.Equal(t, test.status, bp.check(), test.script)
+		assert.Equal(t, test.output, bp.metrics.Output, test.script)
+	}
+}
+
+func TestExecDriverKillsBackgroundChildren(t *testing.T) {
+	bp, err := New("localhost", 8080, &Options{Type: "exec", Timeout: "200ms", Args: util.DynamicMap{
+		"command": "sh", "args": []interface{}{"-c", "sleep 10 & echo started"}}})
+	require.NoError(t, err)
+
+	// The child keeps the output open after the command itself has exited.
+	started := time.Now()
+	assert.Equal(t, StatusDown, bp.check())
+	assert.True(t, time.Since(started) < 5*time.Second)
+	assert.Equal(t, "started\n", bp.metrics.Output)
+}
+
+func TestExecDriverOutputTruncated(t *testing.T) {
+	bp, err := New("localhost", 8080, &Options{Type: "exec", Args: util.DynamicMap{
+		"command": "sh", "args": []interface{}{"-c", "head -c 4096 /dev/zero | tr '\\0' x"}}})
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.check())
+	assert.Len(t, bp.metrics.Output, maxOutput+len("..."))
+}
+
+func TestGRPCDriver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		service string
+		status  StatusType
+	}{
+		{service: "", status: StatusUp},
+		{service: "echo", status: StatusDown},
+		{service: "unknown", status: StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", port, &Options{Type: "grpc", Args: util.DynamicMap{"service": test.service}})
+		require.NoError(t, err)
+		assert.Equal(t, test.status, bp.driver.Check(), test.service)
+	}
+
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+
+	bp, err := New("127.0.0.1", port, &Options{Type: "grpc", Args: util.DynamicMap{"service": "echo"}})
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check())
+}
+
+func TestGRPCDriverNoConnection(t *testing.T) {
+	bp, err := New("127.0.0.1", 1, &Options{Type: "grpc", Timeout: "100ms"})
+	require.NoError(t, err)
+	assert.Equal(t, StatusDown, bp.driver.Check())
+}
+
+func TestUDPDriver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			} else if string(buffer[:n]) == "ping" {
+				conn.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	tests := []struct {
+		args   util.DynamicMap
+		status StatusType
+	}{
+		{args: util.DynamicMap{"payload": "ping", "expect": "pong"}, status: StatusUp},
+		{args: util.DynamicMap{"payload_hex": "70696e67", "expect_hex": "706f6e67"}, status: StatusUp},
+		{args: util.DynamicMap{"payload": "ping", "expect": "ping"}, status: StatusDown},
+		{args: util.DynamicMap{"payload": "hello", "require_response": true}, status: StatusDown},
+		{args: util.DynamicMap{"payload": "hello"}, status: StatusUp},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", port, &Options{Type: "udp", Timeout: "100ms", Args: test.args})
+		require.NoError(t, err)
+		assert.Equal(t, test.status, bp.driver.Check(), "%v", test.args)
+	}
+
+	_, err = New("127.0.0.1", port, &Options{Type: "udp", Args: util.DynamicMap{"payload_hex": "zz"}})
+	assert.Error(t, err)
+}
+
+func TestUDPDriverUnreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	conn.Close()
+
+	bp, err := New("127.0.0.1", port, &Options{Type: "udp", Timeout: "100ms"})
+	require.NoError(t, err)
+	assert.Equal(t, StatusDown, bp.driver.Check())
+}
+
+func TestUDPDriverWithoutReplyRecordsNoLatency(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	bp, err := New("127.0.0.1", uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		&Options{Type: "udp", Timeout: "100ms"})
+	require.NoError(t, err)
+
+	// The silent backend is up, but the timeout isn't its latency.
+	assert.Equal(t, StatusUp, bp.check())
+	assert.Zero(t, bp.metrics.Latency)
+	assert.Zero(t, bp.metrics.LatencyP50)
+}
+
+func TestDNSDriver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			var m dnsmessage.Message
+			if m.Unpack(buffer[:n]) != nil {
+				continue
+			}
+
+			m.Response = true
+
+			if q := m.Questions[0]; q.Name.String() != "example.com." {
+				m.RCode = dnsmessage.RCodeNameError
+			} else if q.Type == dnsmessage.TypeA {
+				m.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+				}}
+			}
+
+			reply, _ := m.Pack()
+			conn.WriteTo(reply, addr)
+		}
+	}()
+
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	tests := []struct {
+		args   util.DynamicMap
+		status StatusType
+	}{
+		{args: util.DynamicMap{"name": "example.com"}, status: StatusUp},
+		{args: util.DynamicMap{"name": "example.com", "answer": "10.0.0.1"}, status: StatusUp},
+		{args: util.DynamicMap{"name": "example.com", "answer": "10.0.0.2"}, status: StatusDown},
+		{args: util.DynamicMap{"name": "example.com", "type": "aaaa", "answer": "::1"}, status: StatusDown},
+		{args: util.DynamicMap{"name": "example.org"}, status: StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", port, &Options{Type: "dns", Timeout: "100ms", Args: test.args})
+		require.NoError(t, err)
+		assert.Equal(t, test.status, bp.driver.Check(), "%v", test.args)
+	}
+
+	_, err = New("127.0.0.1", port, &Options{Type: "dns"})
+	assert.Equal(t, errMissingName, err)
+
+	_, err = New("127.0.0.1", port, &Options{Type: "dns", Args: util.DynamicMap{"name": "example.com", "type": "ANY"}})
+	assert.Equal(t, errUnknownType, err)
+}
+
+func TestTCPDriverSendExpect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer cn.Close()
+
+				cn.Write([]byte("220 ready\r\n"))
+
+				buffer := make([]byte, 64)
+				if n, err := cn.Read(buffer); err == nil && string(buffer[:n]) == "PING\r\n" {
+					cn.Write([]byte("+PONG\r\n"))
+				}
+
+				// Wedged otherwise.
+				cn.Read(buffer)
+			}()
+		}
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		args   util.DynamicMap
+		status StatusType
+	}{
+		{args: util.DynamicMap{"expect": "220 "}, status: StatusUp},
+		{args: util.DynamicMap{"send": "PING\r\n", "expect": "+PONG"}, status: StatusUp},
+		{args: util.DynamicMap{"send_hex": "50494e470d0a", "expect_hex": "2b504f4e47"}, status: StatusUp},
+		{args: util.DynamicMap{"send": "INFO\r\n", "expect": "+PONG", "read_timeout": "100ms"}, status: StatusDown},
+		{args: util.DynamicMap{"expect": "554 ", "read_timeout": "100ms"}, status: StatusDown},
+	}
+
+	for _, test := range tests {
+		bp, err := New("127.0.0.1", port, &Options{Type: "tcp", Args: test.args})
+		require.NoError(t, err)
+		assert.Equal(t, test.status, bp.driver.Check(), "%v", test.args)
+	}
+
+	_, err = New("127.0.0.1", port, &Options{Type: "tcp", Args: util.DynamicMap{"read_timeout": "soon"}})
+	assert.Error(t, err)
+
+	_, err = New("127.0.0.1", port, &Options{Type: "tcp", Timeout: "1s", Args: util.DynamicMap{"read_timeout": "2s"}})
+	assert.Equal(t, errInvalidReadTimeout, err)
+
+	// The pulse timeout bounds the whole check.
+	bp, err := New("127.0.0.1", port, &Options{Type: "tcp", Timeout: "100ms", Args: util.DynamicMap{"expect": "554 "}})
+	require.NoError(t, err)
+	started := time.Now()
+	assert.Equal(t, StatusDown, bp.driver.Check())
+	assert.True(t, time.Since(started) < time.Second)
+}
+
+func TestRegister(t *testing.T) {
+	assert.Contains(t, Drivers(), "tcp")
+	assert.NotContains(t, Drivers(), "custom")
+
+	_, err := New("localhost", 80, &Options{Type: "custom"})
+	assert.Equal(t, ErrUnknownPulseType, err)
+
+	Register("Custom", func(host string, port uint16, timeout time.Duration, args util.DynamicMap) (Driver, error) {
+		return &fakeDriver{}, nil
+	})
+
+	assert.Contains(t, Drivers(), "custom")
+
+	bp, err := New("localhost", 80, &Options{Type: "CUSTOM"})
+	require.NoError(t, err)
+	assert.IsType(t, &fakeDriver{}, bp.driver)
+
+	assert.Panics(t, func() { Register("custom", newNoopDriver) })
+	assert.Panics(t, func() { Register("other", nil) })
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	m := NewMetrics()
+
+	for i := 1; i <= 100; i++ {
+		m.recordLatency(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, 50*time.Millisecond, m.LatencyP50)
+	assert.Equal(t, 90*time.Millisecond, m.LatencyP90)
+	assert.Equal(t, 99*time.Millisecond, m.LatencyP99)
+
+	// Only the last samples are kept.
+	for i := 101; i <= 150; i++ {
+		m.recordLatency(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, 100*time.Millisecond, m.LatencyP50)
+	assert.Equal(t, 149*time.Millisecond, m.LatencyP99)
+
+	m = NewMetrics()
+	m.recordLatency(time.Second)
+	assert.Equal(t, time.Second, m.LatencyP50)
+	assert.Equal(t, time.Second, m.LatencyP99)
+}
+
+type timedDriver struct {
+	roundTrip
+}
+
+func (d *timedDriver) Check() StatusType {
+	time.Sleep(20 * time.Millisecond)
+	d.latency = time.Millisecond
+	return StatusUp
+}
+
+func TestDriverReportsLatency(t *testing.T) {
+	bp, err := New("", 0, &Options{Type: "none"})
+	require.NoError(t, err)
+
+	bp.driver = &timedDriver{}
+	bp.check()
+	assert.Equal(t, time.Millisecond, bp.metrics.Latency)
+	assert.Equal(t, time.Millisecond, bp.metrics.LatencyP50)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	bp, err = New("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port), &Options{Type: "tcp"})
+	require.NoError(t, err)
+	assert.Implements(t, (*Timer)(nil), bp.driver)
+	assert.Equal(t, StatusUp, bp.check())
+	assert.True(t, bp.metrics.Latency > 0)
+}
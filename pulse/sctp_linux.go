@@ -0,0 +1,136 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	errSCTPTimeout = errors.New("timed out while establishing an association")
+)
+
+// How often an association interrupted by a signal is checked for completion.
+const sctpRetryInterval = 10 * time.Millisecond
+
+type sctpPulse struct {
+	Driver
+	roundTrip
+
+	host     string
+	port     uint16
+	endpoint string
+	timeout  time.Duration
+}
+
+func newSCTPDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	return &sctpPulse{
+		host:     host,
+		port:     port,
+		endpoint: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		timeout:  timeout,
+	}, nil
+}
+
+func (p *sctpPulse) Check() StatusType {
+	if err := p.associate(); err != nil {
+		log.Errorf("unable to establish an SCTP association with %s: %s", p.endpoint, err)
+		return StatusDown
+	}
+
+	return StatusUp
+}
+
+// associate establishes and gracefully shuts down an SCTP association with the
+// backend, which requires a successful INIT/INIT-ACK exchange.
+func (p *sctpPulse) associate() error {
+	addr, err := net.ResolveIPAddr("ip", p.host)
+	if err != nil {
+		return err
+	}
+
+	var (
+		family int
+		sa     syscall.Sockaddr
+	)
+
+	if ip := addr.IP.To4(); ip != nil {
+		sa4 := &syscall.SockaddrInet4{Port: int(p.port)}
+		copy(sa4.Addr[:], ip)
+		family, sa = syscall.AF_INET, sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: int(p.port)}
+		copy(sa6.Addr[:], addr.IP.To16())
+		family, sa = syscall.AF_INET6, sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+
+	defer syscall.Close(fd)
+
+	start := time.Now()
+	deadline := start.Add(p.timeout)
+
+	for {
+		// A zero send timeout would block connect() for good.
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			return errSCTPTimeout
+		}
+
+		// Blocking connect() is bound by the send timeout on Linux.
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+
+		// Signals, e.g. the runtime preempting goroutines, interrupt connect() while
+		// the association carries on. Calling it again reports whether it's done.
+		err = syscall.Connect(fd, sa)
+
+		switch {
+		case err == nil || err == syscall.EISCONN:
+			p.since(start)
+			return nil
+		case err == syscall.EINPROGRESS:
+			return errSCTPTimeout
+		case err != syscall.EINTR && err != syscall.EALREADY:
+			return os.NewSyscallError("connect", err)
+		}
+
+		if err == syscall.EALREADY {
+			time.Sleep(sctpRetryInterval)
+		}
+	}
+}
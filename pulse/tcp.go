@@ -21,8 +21,10 @@
 package pulse
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/kobolog/gorb/util"
@@ -30,27 +32,119 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+var (
+	errUnexpectedReply    = errors.New("expected reply not found")
+	errInvalidReadTimeout = errors.New("read timeout must be positive and not longer than the pulse timeout")
+)
+
 type tcpPulse struct {
 	Driver
+	roundTrip
 
 	endpoint string
 	dialer   net.Dialer
+	timeout  time.Duration
+
+	// Optional request and expected reply, e.g. for line protocols.
+	send        []byte
+	expect      []byte
+	readTimeout time.Duration
 }
 
-func newTCPDriver(host string, port uint16, opts util.DynamicMap) (Driver, error) {
-	return &tcpPulse{
-		endpoint: fmt.Sprintf("%s:%d", host, port),
-		dialer:   net.Dialer{DualStack: true, Timeout: 5 * time.Second},
-	}, nil
+func newTCPDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	p := &tcpPulse{
+		endpoint:    net.JoinHostPort(host, strconv.Itoa(int(port))),
+		dialer:      net.Dialer{DualStack: true},
+		timeout:     timeout,
+		readTimeout: timeout,
+	}
+
+	var err error
+
+	if p.send, err = parsePayload(opts, "send"); err != nil {
+		return nil, err
+	} else if p.expect, err = parsePayload(opts, "expect"); err != nil {
+		return nil, err
+	}
+
+	if v := opts.Get("read_timeout", "").(string); len(v) != 0 {
+		if p.readTimeout, err = util.ParseInterval(v); err != nil {
+			return nil, err
+		} else if p.readTimeout <= 0 || p.readTimeout > timeout {
+			return nil, errInvalidReadTimeout
+		}
+	}
+
+	return p, nil
 }
 
 func (p *tcpPulse) Check() StatusType {
-	if socket, err := p.dialer.Dial("tcp", p.endpoint); err != nil {
+	// The whole check, including the connection, must fit into the pulse timeout.
+	deadline := time.Now().Add(p.timeout)
+
+	dialer := p.dialer
+	dialer.Deadline = deadline
+
+	start := time.Now()
+
+	socket, err := dialer.Dial("tcp", p.endpoint)
+	if err != nil {
 		log.Errorf("unable to connect to %s", p.endpoint)
-	} else {
-		socket.Close()
+		return StatusDown
+	}
+
+	defer socket.Close()
+
+	if p.send == nil && p.expect == nil {
+		p.since(start)
 		return StatusUp
 	}
 
-	return StatusDown
+	if readDeadline := time.Now().Add(p.readTimeout); readDeadline.Before(deadline) {
+		deadline = readDeadline
+	}
+
+	socket.SetDeadline(deadline)
+
+	if len(p.send) != 0 {
+		if _, err := socket.Write(p.send); err != nil {
+			log.Errorf("unable to send request to %s: %s", p.endpoint, err)
+			return StatusDown
+		}
+	}
+
+	if p.expect != nil {
+		if err := readExpected(socket, p.expect); err != nil {
+			log.Errorf("unexpected reply from %s: %s", p.endpoint, err)
+			return StatusDown
+		}
+	}
+
+	p.since(start)
+
+	return StatusUp
+}
+
+// readExpected reads from the socket until the expected data is received, looking
+// at the first maxMatchedBody bytes only.
+func readExpected(socket net.Conn, expect []byte) error {
+	var (
+		reply  []byte
+		buffer = make([]byte, 4096)
+	)
+
+	for !bytes.Contains(reply, expect) {
+		if len(reply) >= maxMatchedBody {
+			return errUnexpectedReply
+		}
+
+		n, err := socket.Read(buffer)
+		if err != nil {
+			return err
+		}
+
+		reply = append(reply, buffer[:n]...)
+	}
+
+	return nil
 }
@@ -0,0 +1,140 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kobolog/gorb/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errInvalidPayload = errors.New("payload must be a string")
+
+// Large enough for any UDP datagram.
+const maxDatagram = 65535
+
+type udpPulse struct {
+	Driver
+	roundTrip
+
+	endpoint string
+	timeout  time.Duration
+	payload  []byte
+	expect   []byte
+	response bool
+}
+
+func newUDPDriver(host string, port uint16, timeout time.Duration, opts util.DynamicMap) (Driver, error) {
+	p := &udpPulse{
+		endpoint: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		timeout:  timeout,
+	}
+
+	var err error
+
+	if p.payload, err = parsePayload(opts, "payload"); err != nil {
+		return nil, err
+	} else if p.expect, err = parsePayload(opts, "expect"); err != nil {
+		return nil, err
+	}
+
+	// Without a response to verify, the backend is only considered down if sending
+	// fails, e.g. the port is unreachable.
+	p.response = p.expect != nil || opts.Get("require_response", false).(bool)
+
+	return p, nil
+}
+
+// parsePayload reads binary data from either the name arg as is, or from the name_hex
+// arg as a hex string. It returns nil if neither is set.
+func parsePayload(opts util.DynamicMap, name string) ([]byte, error) {
+	if v, exists := opts[name+"_hex"]; exists {
+		if s, ok := v.(string); ok {
+			return hex.DecodeString(s)
+		}
+		return nil, errInvalidPayload
+	} else if v, exists := opts[name]; exists {
+		if s, ok := v.(string); ok {
+			return []byte(s), nil
+		}
+		return nil, errInvalidPayload
+	}
+
+	return nil, nil
+}
+
+// exchange sends the payload to the endpoint and returns the first reply accepted
+// by the given function, which can be nil to accept any reply.
+func exchange(endpoint string, timeout time.Duration, payload []byte, accept func([]byte) bool) ([]byte, error) {
+	socket, err := net.DialTimeout("udp", endpoint, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	defer socket.Close()
+
+	socket.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := socket.Write(payload); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, maxDatagram)
+
+	for {
+		n, err := socket.Read(buffer)
+		if err != nil {
+			return nil, err
+		} else if accept == nil || accept(buffer[:n]) {
+			return buffer[:n], nil
+		}
+	}
+}
+
+func (p *udpPulse) Check() StatusType {
+	start := time.Now()
+	reply, err := exchange(p.endpoint, p.timeout, p.payload, nil)
+
+	// Without a reply, there's no round trip to measure.
+	p.latency = 0
+
+	if err == nil {
+		p.since(start)
+
+		if !bytes.Contains(reply, p.expect) {
+			log.Errorf("unexpected reply from %s", p.endpoint)
+			return StatusDown
+		}
+	} else if e, ok := err.(net.Error); p.response || !ok || !e.Timeout() {
+		// Including ICMP port unreachable errors.
+		log.Errorf("no reply from %s: %s", p.endpoint, err)
+		return StatusDown
+	}
+
+	return StatusUp
+}
@@ -34,14 +34,16 @@ var (
 	reInterval               *regexp.Regexp
 
 	intervals = map[string]time.Duration{
-		"s":       time.Second,
-		"sec":     time.Second,
-		"seconds": time.Second,
-		"m":       time.Minute,
-		"min":     time.Minute,
-		"minutes": time.Minute,
-		"h":       time.Hour,
-		"hours":   time.Hour,
+		"ms":           time.Millisecond,
+		"milliseconds": time.Millisecond,
+		"s":            time.Second,
+		"sec":          time.Second,
+		"seconds":      time.Second,
+		"m":            time.Minute,
+		"min":          time.Minute,
+		"minutes":      time.Minute,
+		"h":            time.Hour,
+		"hours":        time.Hour,
 	}
 )
 
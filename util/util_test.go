@@ -105,6 +105,7 @@ func TestParseInterval(t *testing.T) {
 		{in: "600s", rv: 600 * time.Second},
 		{in: "2m", rv: 2 * time.Minute},
 		{in: "24h", rv: 24 * time.Hour},
+		{in: "500ms", rv: 500 * time.Millisecond},
 	}
 
 	for _, test := range tests {